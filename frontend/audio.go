@@ -0,0 +1,82 @@
+package frontend
+
+import (
+	"fmt"
+	"github.com/veandco/go-sdl2/sdl"
+	"log"
+	"time"
+	"unsafe"
+)
+
+const (
+	// How much audio we try to keep queued up, in left/right pairs. This is
+	// most of our audio latency.
+	audioTargetQueue = 2048
+	// The most we'll stretch the sample rate by when the queue runs low.
+	// Half a percent isn't audible as a pitch change.
+	audioMaxRateDelta = 0.005
+	audioBytesPerPair = 8
+)
+
+/*
+ * Plays audio through SDL's audio queue. There's no frame limiter, so this is
+ * also what keeps emulation running at the right speed: AudioSamples blocks
+ * while the queue is full. On top of that the sample rate we ask the APU for
+ * is nudged up as the queue drains, so when emulation falls a little behind
+ * we stretch the audio slightly instead of crackling through an underrun.
+ */
+type SDLAudioSink struct {
+	dev  sdl.AudioDeviceID
+	rate float64
+}
+
+func NewSDLAudioSink(rate int) (*SDLAudioSink, error) {
+	want := sdl.AudioSpec{
+		Freq:     int32(rate),
+		Format:   sdl.AUDIO_F32SYS,
+		Channels: 2,
+		Samples:  512,
+	}
+	have := sdl.AudioSpec{}
+	dev, err := sdl.OpenAudioDevice("", 0, &want, &have, 0)
+	if err != nil {
+		return nil, err
+	}
+	if have.Format != sdl.AUDIO_F32SYS || have.Channels != 2 {
+		sdl.CloseAudioDevice(dev)
+		return nil, fmt.Errorf("audio device doesn't support stereo float samples")
+	}
+	sdl.PauseAudioDevice(dev, 0)
+	return &SDLAudioSink{dev, float64(have.Freq)}, nil
+}
+
+// Number of left/right pairs waiting to be played.
+func (a *SDLAudioSink) queued() int {
+	return int(sdl.GetQueuedAudioSize(a.dev)) / audioBytesPerPair
+}
+
+func (a *SDLAudioSink) AudioSamples(samples []float32) {
+	for a.queued() > audioTargetQueue {
+		time.Sleep(time.Millisecond)
+	}
+	if len(samples) == 0 {
+		return
+	}
+	// SDL wants native endian floats, which is exactly what we have.
+	buf := (*[1 << 28]byte)(unsafe.Pointer(&samples[0]))[:len(samples)*4]
+	if err := sdl.QueueAudio(a.dev, buf); err != nil {
+		log.Printf("Failed to queue audio: %v\n", err)
+	}
+}
+
+func (a *SDLAudioSink) SampleRate() float64 {
+	fill := float64(a.queued()) / audioTargetQueue
+	if fill > 1 {
+		fill = 1
+	}
+	return a.rate * (1 + audioMaxRateDelta*(1-fill))
+}
+
+func (a *SDLAudioSink) Close() {
+	sdl.CloseAudioDevice(a.dev)
+}
@@ -6,16 +6,27 @@ import (
 	"github.com/veandco/go-sdl2/sdl"
 	"io"
 	"log"
+	"os"
+	"sync/atomic"
 	"unsafe"
 )
 
 type Frontend struct {
-	updateButtonser  gb.UpdateButtonser
+	sys              *gb.Sys
 	window           *sdl.Window
 	renderer         *sdl.Renderer
 	texture          *sdl.Texture
 	eventWatchHandle sdl.EventWatchHandle
 	buttonState      gb.ButtonState
+
+	// Called when the window gets closed
+	OnQuit func()
+	// Save state slots are stored in files starting with this
+	StatePrefix string
+
+	rewinder *gb.Rewinder
+	// Set (atomically) while the rewind key is held
+	rewinding int32
 }
 
 var colorMap map[gb.Pixel]uint32 = map[gb.Pixel]uint32{
@@ -25,7 +36,7 @@ var colorMap map[gb.Pixel]uint32 = map[gb.Pixel]uint32{
 	3: 0x000000ff,
 }
 
-func NewFrontend(updateButtonser gb.UpdateButtonser) (*Frontend, error) {
+func NewFrontend(sys *gb.Sys) (*Frontend, error) {
 	window, err := sdl.CreateWindow(
 		"Blitzle", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED,
 		800, 600, sdl.WINDOW_SHOWN)
@@ -38,7 +49,7 @@ func NewFrontend(updateButtonser gb.UpdateButtonser) (*Frontend, error) {
 	}
 	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_RGBA8888,
 		sdl.TEXTUREACCESS_STREAMING, int(gb.LCDSizeX), int(gb.LCDSizeY))
-	f := &Frontend{updateButtonser, window, renderer, texture, 0, gb.ButtonState{}}
+	f := &Frontend{sys, window, renderer, texture, 0, gb.ButtonState{}, nil, "", nil, 0}
 	f.eventWatchHandle = sdl.AddEventWatchFunc(f.FilterEvent, nil)
 	return f, nil
 }
@@ -102,24 +113,160 @@ func (f *Frontend) getKey(code sdl.Scancode) *bool {
 	return nil
 }
 
+// F1-F4 pick a save state slot, load with the key alone and save with shift.
+func stateSlot(code sdl.Scancode) int {
+	switch code {
+	case sdl.SCANCODE_F1:
+		return 1
+	case sdl.SCANCODE_F2:
+		return 2
+	case sdl.SCANCODE_F3:
+		return 3
+	case sdl.SCANCODE_F4:
+		return 4
+	}
+	return 0
+}
+
+// 1-4 toggle the sound channels.
+func audioChannel(code sdl.Scancode) uint8 {
+	switch code {
+	case sdl.SCANCODE_1:
+		return gb.AudioSquare1
+	case sdl.SCANCODE_2:
+		return gb.AudioSquare2
+	case sdl.SCANCODE_3:
+		return gb.AudioWave
+	case sdl.SCANCODE_4:
+		return gb.AudioNoise
+	}
+	return 0
+}
+
+var audioChannelName = map[uint8]string{
+	gb.AudioSquare1: "square 1",
+	gb.AudioSquare2: "square 2",
+	gb.AudioWave:    "wave",
+	gb.AudioNoise:   "noise",
+}
+
+func (f *Frontend) toggleAudioChannel(ch uint8) {
+	f.sys.Do(func(sys *gb.Sys) {
+		mask := sys.AudioChannelMask() ^ ch
+		sys.SetAudioChannelMask(mask)
+		if mask&ch != 0 {
+			fmt.Printf("%s unmuted\n", audioChannelName[ch])
+		} else {
+			fmt.Printf("%s muted\n", audioChannelName[ch])
+		}
+	})
+}
+
+func (f *Frontend) statePath(slot int) string {
+	return fmt.Sprintf("%s.ss%d", f.StatePrefix, slot)
+}
+
+func (f *Frontend) saveState(slot int) {
+	path := f.statePath(slot)
+	f.sys.Do(func(sys *gb.Sys) {
+		out, err := os.Create(path)
+		if err != nil {
+			log.Printf("Failed to save state: %v\n", err)
+			return
+		}
+		defer out.Close()
+		if err := sys.SaveState(out); err != nil {
+			log.Printf("Failed to save state: %v\n", err)
+			return
+		}
+		fmt.Printf("saved state to %s\n", path)
+	})
+}
+
+func (f *Frontend) loadState(slot int) {
+	path := f.statePath(slot)
+	f.sys.Do(func(sys *gb.Sys) {
+		in, err := os.Open(path)
+		if err != nil {
+			log.Printf("Failed to load state: %v\n", err)
+			return
+		}
+		defer in.Close()
+		if err := sys.LoadState(in); err != nil {
+			log.Printf("Failed to load state: %v\n", err)
+			return
+		}
+		fmt.Printf("loaded state from %s\n", path)
+	})
+}
+
+/*
+ * Keep budget bytes of history so holding backspace steps back in time. This
+ * must be called before the system starts running.
+ */
+func (f *Frontend) EnableRewind(budget int) {
+	f.rewinder = gb.NewRewinder(budget)
+	f.sys.AddFrameHook(f.rewindFrame)
+}
+
+func (f *Frontend) rewindFrame(sys *gb.Sys) {
+	if atomic.LoadInt32(&f.rewinding) == 0 {
+		if err := f.rewinder.Push(sys); err != nil {
+			log.Printf("Failed to record rewind history: %v\n", err)
+		}
+		return
+	}
+	if _, err := f.rewinder.Rewind(sys); err != nil {
+		log.Printf("Failed to rewind: %v\n", err)
+	}
+}
+
 func (f *Frontend) FilterEvent(e sdl.Event, _ interface{}) bool {
 	switch v := e.(type) {
+	case *sdl.QuitEvent:
+		if f.OnQuit != nil {
+			f.OnQuit()
+		}
 	case *sdl.KeyDownEvent:
+		if slot := stateSlot(v.Keysym.Scancode); slot != 0 && v.Repeat == 0 {
+			if v.Keysym.Mod&uint16(sdl.KMOD_SHIFT) != 0 {
+				f.saveState(slot)
+			} else {
+				f.loadState(slot)
+			}
+		}
+		if ch := audioChannel(v.Keysym.Scancode); ch != 0 && v.Repeat == 0 {
+			f.toggleAudioChannel(ch)
+		}
+		if v.Keysym.Scancode == sdl.SCANCODE_BACKSPACE {
+			atomic.StoreInt32(&f.rewinding, 1)
+		}
 		if k := f.getKey(v.Keysym.Scancode); k != nil {
 			*k = true
 			fmt.Printf("%s pressed\n", buttonName[v.Keysym.Scancode])
-			f.updateButtonser.UpdateButtons(f.buttonState)
+			f.sys.UpdateButtons(f.buttonState)
 		}
 	case *sdl.KeyUpEvent:
+		if v.Keysym.Scancode == sdl.SCANCODE_BACKSPACE {
+			atomic.StoreInt32(&f.rewinding, 0)
+		}
 		if k := f.getKey(v.Keysym.Scancode); k != nil {
 			*k = false
 			fmt.Printf("%s released\n", buttonName[v.Keysym.Scancode])
-			f.updateButtonser.UpdateButtons(f.buttonState)
+			f.sys.UpdateButtons(f.buttonState)
 		}
 	}
 	return false
 }
 
+func (f *Frontend) Rumble(on bool) {
+	if on {
+		fmt.Printf("rumble started\n")
+	} else {
+		fmt.Printf("rumble stopped\n")
+	}
+}
+
 type WriterSerialSwapper struct {
 	Writer io.Writer
 }
@@ -0,0 +1,182 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	wavHeaderSize = 44
+	// VGM files always count time in 44.1kHz samples
+	vgmRate       = 44100
+	vgmVersion    = 0x161
+	vgmHeaderSize = 0x100
+	vgmGBClock    = 4194304
+	vgmCmdGBWrite = 0xb3
+	vgmCmdWait    = 0x61
+	vgmCmdEnd     = 0x66
+)
+
+/*
+ * Records the mixed output to a 16 bit stereo WAV file. The sizes in the
+ * header can only be filled in once we know them, so nothing is playable
+ * until Close.
+ */
+type WAVSink struct {
+	f      *os.File
+	rate   int
+	frames int
+	buf    []byte
+	// The first write error, we can't do anything about it until Close
+	err error
+}
+
+func NewWAVSink(path string, rate int) (*WAVSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAVSink{f: f, rate: rate}
+	// Leave space for the header
+	if _, err := f.Write(make([]byte, wavHeaderSize)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAVSink) AudioSamples(samples []float32) {
+	if w.err != nil {
+		return
+	}
+	w.buf = w.buf[:0]
+	for _, s := range samples {
+		if s > 1 {
+			s = 1
+		} else if s < -1 {
+			s = -1
+		}
+		v := int16(s * 32767)
+		w.buf = append(w.buf, byte(v), byte(v>>8))
+	}
+	if _, w.err = w.f.Write(w.buf); w.err != nil {
+		return
+	}
+	w.frames += len(samples) / 2
+}
+
+func (w *WAVSink) SampleRate() float64 {
+	return float64(w.rate)
+}
+
+func (w *WAVSink) Close() error {
+	if w.err != nil {
+		w.f.Close()
+		return w.err
+	}
+	dataSize := uint32(w.frames * 4)
+	h := &bytes.Buffer{}
+	h.WriteString("RIFF")
+	binary.Write(h, binary.LittleEndian, uint32(wavHeaderSize-8)+dataSize)
+	h.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{
+		uint32(16),         // fmt chunk size
+		uint16(1),          // PCM
+		uint16(2),          // channels
+		uint32(w.rate),     // sample rate
+		uint32(w.rate * 4), // bytes per second
+		uint16(4),          // bytes per frame
+		uint16(16),         // bits per sample
+	} {
+		binary.Write(h, binary.LittleEndian, v)
+	}
+	h.WriteString("data")
+	binary.Write(h, binary.LittleEndian, dataSize)
+	if _, err := w.f.WriteAt(h.Bytes(), 0); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+/*
+ * Logs APU register writes in VGM 1.61 format, which players can turn back
+ * into music and which is a lot easier to diff than audio. The samples
+ * themselves are ignored.
+ */
+type VGMSink struct {
+	w io.WriteCloser
+	// The commands so far, the header goes in front of these at Close
+	data bytes.Buffer
+	// Sys.Wall at the first write, everything is timed relative to that
+	startWall int
+	started   bool
+	// How many samples of waits we've written so far
+	samples int
+	// How many samples of audio we've been sent since the first write, so
+	// we can pad out the end of the log to the full length of the recording
+	heard int
+}
+
+func NewVGMSink(path string) (*VGMSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &VGMSink{w: f}, nil
+}
+
+func (v *VGMSink) AudioSamples(samples []float32) {
+	if v.started {
+		v.heard += len(samples) / 2
+	}
+}
+
+func (v *VGMSink) SampleRate() float64 {
+	return vgmRate
+}
+
+func (v *VGMSink) APUWrite(wall int, addr uint16, val uint8) {
+	if !v.started {
+		v.startWall = wall
+		v.started = true
+	}
+	v.wait(int(int64(wall-v.startWall) * vgmRate / vgmGBClock))
+	v.data.Write([]byte{vgmCmdGBWrite, uint8(addr - 0xff10), val})
+}
+
+// Write enough wait commands to catch up to target samples.
+func (v *VGMSink) wait(target int) {
+	for v.samples < target {
+		n := target - v.samples
+		if n > 0xffff {
+			n = 0xffff
+		}
+		v.data.Write([]byte{vgmCmdWait, uint8(n), uint8(n >> 8)})
+		v.samples += n
+	}
+}
+
+func (v *VGMSink) Close() error {
+	v.wait(v.heard)
+	v.data.WriteByte(vgmCmdEnd)
+	h := make([]byte, vgmHeaderSize)
+	copy(h, "Vgm ")
+	binary.LittleEndian.PutUint32(h[0x04:], uint32(vgmHeaderSize+v.data.Len()-0x04))
+	binary.LittleEndian.PutUint32(h[0x08:], vgmVersion)
+	binary.LittleEndian.PutUint32(h[0x18:], uint32(v.samples))
+	// Relative to the field itself
+	binary.LittleEndian.PutUint32(h[0x34:], vgmHeaderSize-0x34)
+	binary.LittleEndian.PutUint32(h[0x80:], vgmGBClock)
+	if _, err := v.w.Write(h); err != nil {
+		v.w.Close()
+		return err
+	}
+	if _, err := v.w.Write(v.data.Bytes()); err != nil {
+		v.w.Close()
+		return err
+	}
+	return v.w.Close()
+}
@@ -0,0 +1,968 @@
+package gb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+const (
+	apuStartAddr  uint16 = 0xff10
+	apuEndAddr    uint16 = 0xff3f
+	waveRAMAddr   uint16 = 0xff30
+	nr10Addr      uint16 = 0xff10
+	nr11Addr      uint16 = 0xff11
+	nr12Addr      uint16 = 0xff12
+	nr13Addr      uint16 = 0xff13
+	nr14Addr      uint16 = 0xff14
+	nr21Addr      uint16 = 0xff16
+	nr22Addr      uint16 = 0xff17
+	nr23Addr      uint16 = 0xff18
+	nr24Addr      uint16 = 0xff19
+	nr30Addr      uint16 = 0xff1a
+	nr31Addr      uint16 = 0xff1b
+	nr32Addr      uint16 = 0xff1c
+	nr33Addr      uint16 = 0xff1d
+	nr34Addr      uint16 = 0xff1e
+	nr41Addr      uint16 = 0xff20
+	nr42Addr      uint16 = 0xff21
+	nr43Addr      uint16 = 0xff22
+	nr44Addr      uint16 = 0xff23
+	nr50Addr      uint16 = 0xff24
+	nr51Addr      uint16 = 0xff25
+	nr52Addr      uint16 = 0xff26
+	apuRegsLength        = int(apuEndAddr-apuStartAddr) + 1
+)
+
+/*
+ * Bits that always read back as 1, either because they're write-only or
+ * because nothing is there. Indexed from FF10h.
+ */
+var apuReadMask [apuRegsLength]uint8 = [apuRegsLength]uint8{
+	0x80, 0x3f, 0x00, 0xff, 0xbf, // NR10-NR14
+	0xff, 0x3f, 0x00, 0xff, 0xbf, // NR20-NR24
+	0x7f, 0xff, 0x9f, 0xff, 0xbf, // NR30-NR34
+	0xff, 0xff, 0x00, 0x00, 0xbf, // NR40-NR44
+	0x00, 0x00, 0x70, // NR50-NR52
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Unused
+	// Wave RAM reads back as written
+}
+
+// Bits for Sys.SetAudioChannelMask, in the same order as NR51 and NR52.
+const (
+	AudioSquare1 uint8 = 1 << iota
+	AudioSquare2
+	AudioWave
+	AudioNoise
+	AllAudioChannels uint8 = 0x0f
+)
+
+/*
+ * Something to play or record the APU output. Samples come in batches of
+ * interleaved left/right pairs from -1.0 to 1.0.
+ */
+type AudioSink interface {
+	AudioSamples(samples []float32)
+	// The rate (in Hz) the sink wants samples at. This is checked after
+	// every batch, so sinks can nudge it to keep their buffers level. A
+	// rate of 0 turns the sink off until it reports something else.
+	SampleRate() float64
+}
+
+/*
+ * Optionally implemented by an AudioSink that wants to see every write to
+ * FF10-FF3F, along with Sys.Wall at the time of the write. When the sink is
+ * attached it first gets a write for each register to bring it up to date.
+ */
+type APUWriteObserver interface {
+	APUWrite(wall int, addr uint16, val uint8)
+}
+
+// Send everything to all of sinks. Each one gets samples at its own rate.
+func MultiAudioSink(sinks ...AudioSink) AudioSink {
+	return &multiAudioSink{sinks}
+}
+
+type multiAudioSink struct {
+	sinks []AudioSink
+}
+
+func (m *multiAudioSink) AudioSamples(samples []float32) {
+	for _, s := range m.sinks {
+		s.AudioSamples(samples)
+	}
+}
+
+// The APU resamples for each sink separately, so this is only here to
+// satisfy AudioSink.
+func (m *multiAudioSink) SampleRate() float64 {
+	if len(m.sinks) == 0 {
+		return 0
+	}
+	return m.sinks[0].SampleRate()
+}
+
+func (m *multiAudioSink) APUWrite(wall int, addr uint16, val uint8) {
+	for _, s := range m.sinks {
+		if o, ok := s.(APUWriteObserver); ok {
+			o.APUWrite(wall, addr, val)
+		}
+	}
+}
+
+// Number of left/right pairs handed to the sink at a time.
+const audioBatchSize = 512
+
+/*
+ * The APU has two square wave channels (the first with a frequency sweep), a
+ * channel that plays back 32 samples out of wave RAM and a noise channel.
+ * Everything other than the channel timers is clocked by the frame sequencer,
+ * which ticks at 512Hz off of DIV:
+ *
+ *   Step   Length  Sweep  Envelope
+ *   0      x
+ *   1
+ *   2      x       x
+ *   3
+ *   4      x
+ *   5
+ *   6      x       x
+ *   7                     x
+ */
+type APU struct {
+	// FF10-FF3F as written, most of the channel configuration is read
+	// straight out of here.
+	regs  [apuRegsLength]uint8
+	power bool
+
+	ch1 squareChannel
+	ch2 squareChannel
+	ch3 waveChannel
+	ch4 noiseChannel
+
+	// The next frame sequencer step to run
+	fsStep     int
+	lastDivBit uint8
+
+	// Channels that make it to the output, for listening to them in
+	// isolation. This isn't part of the emulated state.
+	channelMask uint8
+
+	outputs  []*audioOutput
+	observer APUWriteObserver
+	// Sys.Wall as of the last step, for timestamping writes
+	wall int
+}
+
+// A sink along with what it takes to resample the output to its rate.
+type audioOutput struct {
+	sink AudioSink
+	rate float64
+	// Cycles left until the next output sample
+	clock float64
+	// Running sums of the mixed output since the last sample, so we
+	// average rather than just dropping everything in between
+	sumLeft  float32
+	sumRight float32
+	sumCount int
+	// High-pass filter state, standing in for the capacitors that block
+	// the DC offset on real hardware
+	capLeft   float32
+	capRight  float32
+	capCharge float32
+	batch     []float32
+}
+
+func NewAPU() *APU {
+	a := &APU{channelMask: AllAudioChannels}
+	a.ch1 = squareChannel{apu: a, base: nr10Addr, hasSweep: true}
+	a.ch2 = squareChannel{apu: a, base: nr10Addr + 5}
+	a.ch3 = waveChannel{apu: a}
+	a.ch4 = noiseChannel{apu: a}
+	a.ch1.length.max = 64
+	a.ch2.length.max = 64
+	a.ch3.length.max = 256
+	a.ch4.length.max = 64
+	return a
+}
+
+// Registers as the boot ROM leaves them, having just played the startup
+// chime on channel 1.
+func (a *APU) SetPostBootloaderState() {
+	a.setPower(true)
+	for addr, val := range map[uint16]uint8{
+		nr10Addr: 0x80, nr11Addr: 0xbf, nr12Addr: 0xf3, nr14Addr: 0x3f,
+		nr21Addr: 0x3f, nr24Addr: 0x3f,
+		nr30Addr: 0x7f, nr31Addr: 0xff, nr32Addr: 0x9f, nr34Addr: 0x3f,
+		nr41Addr: 0xff, nr44Addr: 0x3f,
+		nr50Addr: 0x77, nr51Addr: 0xf3,
+	} {
+		a.regs[addr-apuStartAddr] = val
+	}
+	a.ch1.enabled = true
+	a.ch1.env.trigger(0xf3)
+	a.ch1.env.volume = 0
+}
+
+func (a *APU) reg(addr uint16) uint8 {
+	return a.regs[addr-apuStartAddr]
+}
+
+func (a *APU) R(addr uint16) uint8 {
+	if addr == nr52Addr {
+		v := uint8(0x70)
+		if a.power {
+			v |= 0x80
+		}
+		for i, on := range []bool{a.ch1.enabled, a.ch2.enabled, a.ch3.enabled, a.ch4.enabled} {
+			if on {
+				v |= 1 << uint(i)
+			}
+		}
+		return v
+	}
+	if addr >= waveRAMAddr {
+		return a.ch3.readWaveRAM(addr)
+	}
+	return a.reg(addr) | apuReadMask[addr-apuStartAddr]
+}
+
+func (a *APU) W(addr uint16, val uint8) {
+	if a.observer != nil {
+		a.observe(addr, val)
+	}
+	if addr >= waveRAMAddr {
+		a.ch3.writeWaveRAM(addr, val)
+		return
+	}
+	if addr == nr52Addr {
+		a.setPower(val&0x80 != 0)
+		return
+	}
+	if !a.power {
+		// On the DMG the length counters keep working with the power
+		// off, but nothing else can be written.
+		switch addr {
+		case nr11Addr:
+			a.ch1.length.load(uint(val & 0x3f))
+		case nr21Addr:
+			a.ch2.length.load(uint(val & 0x3f))
+		case nr31Addr:
+			a.ch3.length.load(uint(val))
+		case nr41Addr:
+			a.ch4.length.load(uint(val & 0x3f))
+		}
+		return
+	}
+	prev := a.regs[addr-apuStartAddr]
+	a.regs[addr-apuStartAddr] = val
+	switch addr {
+	case nr10Addr:
+		a.ch1.sweepWritten()
+	case nr11Addr:
+		a.ch1.length.load(uint(val & 0x3f))
+	case nr12Addr:
+		a.ch1.dacWritten()
+	case nr14Addr:
+		a.ch1.triggerWritten(prev, val)
+	case nr21Addr:
+		a.ch2.length.load(uint(val & 0x3f))
+	case nr22Addr:
+		a.ch2.dacWritten()
+	case nr24Addr:
+		a.ch2.triggerWritten(prev, val)
+	case nr30Addr:
+		a.ch3.dacWritten()
+	case nr31Addr:
+		a.ch3.length.load(uint(val))
+	case nr34Addr:
+		a.ch3.triggerWritten(prev, val)
+	case nr41Addr:
+		a.ch4.length.load(uint(val & 0x3f))
+	case nr42Addr:
+		a.ch4.dacWritten()
+	case nr44Addr:
+		a.ch4.triggerWritten(prev, val)
+	}
+}
+
+func (a *APU) Asserts(addr uint16) bool {
+	return addr >= apuStartAddr && addr <= apuEndAddr
+}
+
+// Turning the power off clears every register and stops all the channels.
+func (a *APU) setPower(on bool) {
+	if on == a.power {
+		return
+	}
+	if !on {
+		// The length counters survive, they're kept outside of regs.
+		for i := range a.regs[:nr52Addr-apuStartAddr] {
+			a.regs[i] = 0
+		}
+		a.ch1.enabled = false
+		a.ch2.enabled = false
+		a.ch3.enabled = false
+		a.ch4.enabled = false
+	} else {
+		a.fsStep = 0
+		a.ch1.dutyPos = 0
+		a.ch2.dutyPos = 0
+		a.ch3.position = 0
+	}
+	a.power = on
+}
+
+// Whether the frame sequencer is in the half of its period where the next
+// step won't clock the length counters. This matters for some length quirks.
+func (a *APU) lengthHalf() bool {
+	return a.fsStep%2 == 1
+}
+
+func (a *APU) Step(sys *Sys) {
+	a.wall = sys.Wall
+	// The frame sequencer is clocked by bit 4 of DIV (bit 12 of the
+	// system counter) going low, so resetting DIV can clock it early.
+	divBit := uint8(sys.timer.counter>>12) & 0x01
+	fsClock := a.lastDivBit == 1 && divBit == 0
+	a.lastDivBit = divBit
+	if a.power {
+		if fsClock {
+			a.stepFrameSequencer()
+		}
+		a.ch1.step(4)
+		a.ch2.step(4)
+		a.ch3.step(4)
+		a.ch4.step(4)
+	}
+	// Keep sampling while powered off so recordings don't lose the silence
+	if len(a.outputs) != 0 {
+		left, right := a.mix()
+		for _, o := range a.outputs {
+			o.sample(left, right, 4)
+		}
+	}
+}
+
+func (a *APU) setSink(sink AudioSink) {
+	a.outputs = nil
+	a.observer = nil
+	if sink == nil {
+		return
+	}
+	if o, ok := sink.(APUWriteObserver); ok {
+		a.observer = o
+		a.replayRegisters()
+	}
+	a.addOutputs(sink)
+}
+
+// Sinks that were combined with MultiAudioSink each get their own output,
+// so none of them is stuck with another's sample rate.
+func (a *APU) addOutputs(sink AudioSink) {
+	if m, ok := sink.(*multiAudioSink); ok {
+		for _, s := range m.sinks {
+			a.addOutputs(s)
+		}
+		return
+	}
+	o := &audioOutput{sink: sink, batch: make([]float32, 0, audioBatchSize*2)}
+	o.setRate(sink.SampleRate())
+	a.outputs = append(a.outputs, o)
+}
+
+/*
+ * Tell the observer about the current value of every register. Wave RAM goes
+ * first since it may only be accessible before channel 3 is turned on, and
+ * the trigger bits are left out so nothing starts playing early.
+ */
+func (a *APU) replayRegisters() {
+	if !a.power {
+		a.observer.APUWrite(a.wall, nr52Addr, 0x00)
+		return
+	}
+	a.observe(nr52Addr, 0x80)
+	for addr := waveRAMAddr; addr <= apuEndAddr; addr++ {
+		a.observe(addr, a.reg(addr))
+	}
+	for addr := nr10Addr; addr < nr52Addr; addr++ {
+		val := a.reg(addr)
+		switch addr {
+		case nr14Addr, nr24Addr, nr34Addr, nr44Addr:
+			val &^= 0x80
+		}
+		a.observe(addr, val)
+	}
+}
+
+// Muted channels get taken out of NR51 so they stay quiet in register logs.
+func (a *APU) observe(addr uint16, val uint8) {
+	if addr == nr51Addr {
+		val &= a.channelMask | a.channelMask<<4
+	}
+	a.observer.APUWrite(a.wall, addr, val)
+}
+
+func (a *APU) setChannelMask(mask uint8) {
+	a.channelMask = mask & AllAudioChannels
+	if a.observer != nil && a.power {
+		a.observe(nr51Addr, a.reg(nr51Addr))
+	}
+}
+
+func (o *audioOutput) setRate(rate float64) {
+	if rate <= 0 {
+		// Off, so start the next period afresh when it comes back
+		o.rate, o.clock = 0, 0
+		o.sumLeft, o.sumRight, o.sumCount = 0, 0, 0
+		return
+	}
+	o.clock += float64(clkFreq)/rate - o.period()
+	o.capCharge = float32(math.Pow(0.999958, float64(clkFreq)/rate))
+	o.rate = rate
+}
+
+func (o *audioOutput) period() float64 {
+	if o.rate == 0 {
+		return 0
+	}
+	return float64(clkFreq) / o.rate
+}
+
+func (o *audioOutput) highPass(in float32, capacitor *float32) float32 {
+	out := in - *capacitor
+	*capacitor = in - out*o.capCharge
+	return out
+}
+
+func (o *audioOutput) sample(left float32, right float32, cycles int) {
+	if o.rate == 0 {
+		// Nothing gets sent while the sink is off, so keep asking
+		if rate := o.sink.SampleRate(); rate > 0 {
+			o.setRate(rate)
+		}
+		return
+	}
+	o.sumLeft += left
+	o.sumRight += right
+	o.sumCount++
+	o.clock -= float64(cycles)
+	if o.clock > 0 {
+		return
+	}
+	o.clock += o.period()
+	n := float32(o.sumCount)
+	o.batch = append(o.batch,
+		o.highPass(o.sumLeft/n, &o.capLeft),
+		o.highPass(o.sumRight/n, &o.capRight))
+	o.sumLeft, o.sumRight, o.sumCount = 0, 0, 0
+	if len(o.batch) < cap(o.batch) {
+		return
+	}
+	o.sink.AudioSamples(o.batch)
+	o.batch = o.batch[:0]
+	if rate := o.sink.SampleRate(); rate != o.rate {
+		o.setRate(rate)
+	}
+}
+
+func (a *APU) stepFrameSequencer() {
+	if a.fsStep%2 == 0 {
+		a.ch1.length.clock(&a.ch1.enabled, a.ch1.lengthEnabled())
+		a.ch2.length.clock(&a.ch2.enabled, a.ch2.lengthEnabled())
+		a.ch3.length.clock(&a.ch3.enabled, a.reg(nr34Addr)&0x40 != 0)
+		a.ch4.length.clock(&a.ch4.enabled, a.reg(nr44Addr)&0x40 != 0)
+	}
+	if a.fsStep == 2 || a.fsStep == 6 {
+		a.ch1.clockSweep()
+	}
+	if a.fsStep == 7 {
+		a.ch1.env.clock()
+		a.ch2.env.clock()
+		a.ch4.env.clock()
+	}
+	a.fsStep = (a.fsStep + 1) % 8
+}
+
+// Convert a channel's 0-15 output to -1.0 to 1.0. If the DAC is off the
+// channel contributes nothing at all.
+func dac(on bool, v uint8) float32 {
+	if !on {
+		return 0
+	}
+	return float32(v)/7.5 - 1
+}
+
+/*
+ * Mix the channels down to left and right samples from -1.0 to 1.0 according
+ * to NR51 (which channels go where) and NR50 (master volume).
+ */
+func (a *APU) mix() (float32, float32) {
+	if !a.power {
+		return 0, 0
+	}
+	outs := [4]float32{
+		dac(a.ch1.dacOn(), a.ch1.output()),
+		dac(a.ch2.dacOn(), a.ch2.output()),
+		dac(a.ch3.dacOn(), a.ch3.output()),
+		dac(a.ch4.dacOn(), a.ch4.output()),
+	}
+	nr51 := a.reg(nr51Addr) & (a.channelMask | a.channelMask<<4)
+	var left, right float32
+	for i, out := range outs {
+		if nr51&(0x10<<uint(i)) != 0 {
+			left += out
+		}
+		if nr51&(0x01<<uint(i)) != 0 {
+			right += out
+		}
+	}
+	nr50 := a.reg(nr50Addr)
+	left *= float32((nr50>>4)&0x07+1) / 8
+	right *= float32(nr50&0x07+1) / 8
+	return left / 4, right / 4
+}
+
+func (a *APU) State() string {
+	o := bytes.Buffer{}
+	o.WriteString(fmt.Sprintf("APU:\n"))
+	o.WriteString(fmt.Sprintf("  NR52: %02Xh\n", a.R(nr52Addr)))
+	o.WriteString(fmt.Sprintf("  frame sequencer step: %d\n", a.fsStep))
+	return o.String()
+}
+
+func (a *APU) saveState(w *stateWriter) {
+	w.write(a.regs[:], a.power, int32(a.fsStep), a.lastDivBit)
+	a.ch1.saveState(w)
+	a.ch2.saveState(w)
+	a.ch3.saveState(w)
+	a.ch4.saveState(w)
+}
+
+func (a *APU) loadState(r *stateReader) {
+	var fsStep int32
+	r.read(a.regs[:], &a.power, &fsStep, &a.lastDivBit)
+	a.fsStep = int(fsStep)
+	a.ch1.loadState(r)
+	a.ch2.loadState(r)
+	a.ch3.loadState(r)
+	a.ch4.loadState(r)
+}
+
+// Counts down at 256Hz and turns the channel off when it hits 0.
+type lengthCounter struct {
+	max     uint
+	counter uint
+}
+
+func (l *lengthCounter) load(v uint) {
+	l.counter = l.max - v
+}
+
+func (l *lengthCounter) clock(channelEnabled *bool, lengthEnabled bool) {
+	if !lengthEnabled || l.counter == 0 {
+		return
+	}
+	l.counter--
+	if l.counter == 0 {
+		*channelEnabled = false
+	}
+}
+
+/*
+ * Handle a write to NRx4. This has a couple of quirks: enabling the length
+ * counter in the half of the frame sequencer period where it won't be
+ * clocked next clocks it once right away, and triggering with a zero length
+ * reloads it (minus that extra clock if it applies).
+ */
+func (l *lengthCounter) write(a *APU, wasEnabled bool, val uint8, channelEnabled *bool) {
+	enabled := val&0x40 != 0
+	trigger := val&0x80 != 0
+	extraClock := a.lengthHalf() && !wasEnabled && enabled
+	if extraClock && l.counter != 0 {
+		l.counter--
+		if l.counter == 0 && !trigger {
+			*channelEnabled = false
+		}
+	}
+	if trigger && l.counter == 0 {
+		l.counter = l.max
+		if extraClock {
+			l.counter--
+		}
+	}
+}
+
+// Volume envelope, configured by NRx2.
+type envelope struct {
+	volume uint8
+	timer  uint8
+	nrx2   uint8
+}
+
+func (e *envelope) saveState(w *stateWriter) {
+	w.write(e.volume, e.timer, e.nrx2)
+}
+
+func (e *envelope) loadState(r *stateReader) {
+	r.read(&e.volume, &e.timer, &e.nrx2)
+}
+
+func (e *envelope) trigger(nrx2 uint8) {
+	e.nrx2 = nrx2
+	e.volume = nrx2 >> 4
+	e.timer = e.period()
+}
+
+func (e *envelope) period() uint8 {
+	p := e.nrx2 & 0x07
+	if p == 0 {
+		return 8
+	}
+	return p
+}
+
+func (e *envelope) clock() {
+	if e.nrx2&0x07 == 0 {
+		return
+	}
+	e.timer--
+	if e.timer != 0 {
+		return
+	}
+	e.timer = e.period()
+	if e.nrx2&0x08 != 0 && e.volume < 15 {
+		e.volume++
+	} else if e.nrx2&0x08 == 0 && e.volume > 0 {
+		e.volume--
+	}
+}
+
+var dutyTable [4][8]uint8 = [4][8]uint8{
+	{0, 0, 0, 0, 0, 0, 0, 1}, // 12.5%
+	{1, 0, 0, 0, 0, 0, 0, 1}, // 25%
+	{1, 0, 0, 0, 0, 1, 1, 1}, // 50%
+	{0, 1, 1, 1, 1, 1, 1, 0}, // 75%
+}
+
+type squareChannel struct {
+	apu      *APU
+	base     uint16
+	hasSweep bool
+
+	enabled bool
+	length  lengthCounter
+	env     envelope
+	timer   int
+	dutyPos uint8
+
+	// Sweep state, channel 1 only
+	sweepEnabled bool
+	sweepTimer   uint8
+	shadowFreq   uint16
+	// Whether a sweep calculation has used negate mode since the last
+	// trigger, in which case clearing the negate bit kills the channel.
+	sweepNegated bool
+}
+
+func (c *squareChannel) saveState(w *stateWriter) {
+	w.write(c.enabled, uint32(c.length.counter), int32(c.timer), c.dutyPos)
+	c.env.saveState(w)
+	w.write(c.sweepEnabled, c.sweepTimer, c.shadowFreq, c.sweepNegated)
+}
+
+func (c *squareChannel) loadState(r *stateReader) {
+	var length uint32
+	var timer int32
+	r.read(&c.enabled, &length, &timer, &c.dutyPos)
+	c.env.loadState(r)
+	r.read(&c.sweepEnabled, &c.sweepTimer, &c.shadowFreq, &c.sweepNegated)
+	c.length.counter = uint(length)
+	c.timer = int(timer)
+}
+
+func (c *squareChannel) nr(i uint16) uint8 {
+	return c.apu.reg(c.base + i)
+}
+
+func (c *squareChannel) freq() uint16 {
+	return uint16(c.nr(3)) | uint16(c.nr(4)&0x07)<<8
+}
+
+func (c *squareChannel) setFreq(f uint16) {
+	c.apu.regs[c.base+3-apuStartAddr] = uint8(f)
+	c.apu.regs[c.base+4-apuStartAddr] = c.nr(4)&^0x07 | uint8(f>>8)&0x07
+}
+
+func (c *squareChannel) lengthEnabled() bool {
+	return c.nr(4)&0x40 != 0
+}
+
+func (c *squareChannel) dacOn() bool {
+	return c.nr(2)&0xf8 != 0
+}
+
+func (c *squareChannel) dacWritten() {
+	if !c.dacOn() {
+		c.enabled = false
+	}
+}
+
+func (c *squareChannel) triggerWritten(prev uint8, val uint8) {
+	c.length.write(c.apu, prev&0x40 != 0, val, &c.enabled)
+	if val&0x80 == 0 {
+		return
+	}
+	c.enabled = c.dacOn()
+	c.timer = (2048 - int(c.freq())) * 4
+	c.env.trigger(c.nr(2))
+	if c.hasSweep {
+		c.triggerSweep()
+	}
+}
+
+func (c *squareChannel) step(cycles int) {
+	c.timer -= cycles
+	for c.timer <= 0 {
+		c.timer += (2048 - int(c.freq())) * 4
+		c.dutyPos = (c.dutyPos + 1) % 8
+	}
+}
+
+func (c *squareChannel) output() uint8 {
+	if !c.enabled {
+		return 0
+	}
+	duty := c.nr(1) >> 6
+	return dutyTable[duty][c.dutyPos] * c.env.volume
+}
+
+func (c *squareChannel) sweepPeriod() uint8 {
+	return (c.nr(0) >> 4) & 0x07
+}
+
+func (c *squareChannel) sweepShift() uint8 {
+	return c.nr(0) & 0x07
+}
+
+func (c *squareChannel) sweepNegate() bool {
+	return c.nr(0)&0x08 != 0
+}
+
+func (c *squareChannel) reloadSweepTimer() {
+	c.sweepTimer = c.sweepPeriod()
+	if c.sweepTimer == 0 {
+		c.sweepTimer = 8
+	}
+}
+
+func (c *squareChannel) triggerSweep() {
+	c.shadowFreq = c.freq()
+	c.reloadSweepTimer()
+	c.sweepNegated = false
+	c.sweepEnabled = c.sweepPeriod() != 0 || c.sweepShift() != 0
+	if c.sweepShift() != 0 {
+		c.sweepCalc()
+	}
+}
+
+// Work out the next sweep frequency, turning the channel off if it
+// overflows.
+func (c *squareChannel) sweepCalc() uint16 {
+	delta := c.shadowFreq >> c.sweepShift()
+	var f uint16
+	if c.sweepNegate() {
+		f = c.shadowFreq - delta
+		c.sweepNegated = true
+	} else {
+		f = c.shadowFreq + delta
+	}
+	if f > 2047 {
+		c.enabled = false
+	}
+	return f
+}
+
+func (c *squareChannel) sweepWritten() {
+	if c.sweepNegated && !c.sweepNegate() {
+		c.enabled = false
+	}
+}
+
+func (c *squareChannel) clockSweep() {
+	c.sweepTimer--
+	if c.sweepTimer != 0 {
+		return
+	}
+	c.reloadSweepTimer()
+	if !c.sweepEnabled || c.sweepPeriod() == 0 {
+		return
+	}
+	f := c.sweepCalc()
+	if f <= 2047 && c.sweepShift() != 0 {
+		c.shadowFreq = f
+		c.setFreq(f)
+		// Check for overflow again with the new frequency
+		c.sweepCalc()
+	}
+}
+
+type waveChannel struct {
+	apu *APU
+
+	enabled  bool
+	length   lengthCounter
+	timer    int
+	position uint8
+}
+
+func (c *waveChannel) saveState(w *stateWriter) {
+	w.write(c.enabled, uint32(c.length.counter), int32(c.timer), c.position)
+}
+
+func (c *waveChannel) loadState(r *stateReader) {
+	var length uint32
+	var timer int32
+	r.read(&c.enabled, &length, &timer, &c.position)
+	c.length.counter = uint(length)
+	c.timer = int(timer)
+}
+
+func (c *waveChannel) freq() uint16 {
+	return uint16(c.apu.reg(nr33Addr)) | uint16(c.apu.reg(nr34Addr)&0x07)<<8
+}
+
+func (c *waveChannel) dacOn() bool {
+	return c.apu.reg(nr30Addr)&0x80 != 0
+}
+
+func (c *waveChannel) dacWritten() {
+	if !c.dacOn() {
+		c.enabled = false
+	}
+}
+
+func (c *waveChannel) triggerWritten(prev uint8, val uint8) {
+	c.length.write(c.apu, prev&0x40 != 0, val, &c.enabled)
+	if val&0x80 == 0 {
+		return
+	}
+	c.enabled = c.dacOn()
+	c.timer = (2048 - int(c.freq())) * 2
+	c.position = 0
+}
+
+func (c *waveChannel) step(cycles int) {
+	c.timer -= cycles
+	for c.timer <= 0 {
+		c.timer += (2048 - int(c.freq())) * 2
+		c.position = (c.position + 1) % 32
+	}
+}
+
+// While the channel is playing, wave RAM accesses go to whichever byte it's
+// currently playing.
+func (c *waveChannel) waveRAMIndex(addr uint16) uint16 {
+	if c.enabled {
+		return waveRAMAddr - apuStartAddr + uint16(c.position/2)
+	}
+	return addr - apuStartAddr
+}
+
+func (c *waveChannel) readWaveRAM(addr uint16) uint8 {
+	return c.apu.regs[c.waveRAMIndex(addr)]
+}
+
+func (c *waveChannel) writeWaveRAM(addr uint16, val uint8) {
+	c.apu.regs[c.waveRAMIndex(addr)] = val
+}
+
+func (c *waveChannel) output() uint8 {
+	if !c.enabled {
+		return 0
+	}
+	sample := c.apu.regs[waveRAMAddr-apuStartAddr+uint16(c.position/2)]
+	if c.position%2 == 0 {
+		sample >>= 4
+	}
+	sample &= 0x0f
+	// 0 is mute, otherwise it's a right shift of one less than the code
+	code := (c.apu.reg(nr32Addr) >> 5) & 0x03
+	if code == 0 {
+		return 0
+	}
+	return sample >> (code - 1)
+}
+
+var noiseDivisors [8]int = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+type noiseChannel struct {
+	apu *APU
+
+	enabled bool
+	length  lengthCounter
+	env     envelope
+	timer   int
+	lfsr    uint16
+}
+
+func (c *noiseChannel) saveState(w *stateWriter) {
+	w.write(c.enabled, uint32(c.length.counter), int32(c.timer), c.lfsr)
+	c.env.saveState(w)
+}
+
+func (c *noiseChannel) loadState(r *stateReader) {
+	var length uint32
+	var timer int32
+	r.read(&c.enabled, &length, &timer, &c.lfsr)
+	c.env.loadState(r)
+	c.length.counter = uint(length)
+	c.timer = int(timer)
+}
+
+func (c *noiseChannel) period() int {
+	nr43 := c.apu.reg(nr43Addr)
+	return noiseDivisors[nr43&0x07] << (nr43 >> 4)
+}
+
+func (c *noiseChannel) dacOn() bool {
+	return c.apu.reg(nr42Addr)&0xf8 != 0
+}
+
+func (c *noiseChannel) dacWritten() {
+	if !c.dacOn() {
+		c.enabled = false
+	}
+}
+
+func (c *noiseChannel) triggerWritten(prev uint8, val uint8) {
+	c.length.write(c.apu, prev&0x40 != 0, val, &c.enabled)
+	if val&0x80 == 0 {
+		return
+	}
+	c.enabled = c.dacOn()
+	c.timer = c.period()
+	c.env.trigger(c.apu.reg(nr42Addr))
+	c.lfsr = 0x7fff
+}
+
+func (c *noiseChannel) step(cycles int) {
+	c.timer -= cycles
+	for c.timer <= 0 {
+		c.timer += c.period()
+		// XOR the bottom two bits and feed them back in at the top (and
+		// also bit 6 in 7 bit mode).
+		x := (c.lfsr ^ c.lfsr>>1) & 0x01
+		c.lfsr = c.lfsr>>1 | x<<14
+		if c.apu.reg(nr43Addr)&0x08 != 0 {
+			c.lfsr = c.lfsr&^0x40 | x<<6
+		}
+	}
+}
+
+func (c *noiseChannel) output() uint8 {
+	if !c.enabled || c.lfsr&0x01 != 0 {
+		return 0
+	}
+	return c.env.volume
+}
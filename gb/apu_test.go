@@ -0,0 +1,387 @@
+package gb
+
+import "testing"
+
+func poweredAPU() *APU {
+	a := NewAPU()
+	a.W(nr52Addr, 0x80)
+	return a
+}
+
+func checkChannelsOn(t *testing.T, a *APU, expected uint8) {
+	if got := a.R(nr52Addr) & 0x0f; got != expected {
+		t.Errorf("expected channel status %Xh, got %Xh\n", expected, got)
+	}
+}
+
+func TestAPUReadMasks(t *testing.T) {
+	a := poweredAPU()
+	for addr := apuStartAddr; addr < nr52Addr; addr++ {
+		a.W(addr, 0x00)
+		if got := a.R(addr); got != apuReadMask[addr-apuStartAddr] {
+			t.Errorf("expected %04Xh to read %02Xh, got %02Xh\n", addr, apuReadMask[addr-apuStartAddr], got)
+		}
+	}
+	if got := a.R(nr52Addr); got != 0xf0 {
+		t.Errorf("expected NR52=F0h, got %02Xh\n", got)
+	}
+}
+
+func TestAPUPowerOff(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr50Addr, 0x77)
+	a.W(nr12Addr, 0xf0)
+	a.W(nr14Addr, 0x80)
+	checkChannelsOn(t, a, 0x01)
+
+	a.W(nr52Addr, 0x00)
+	checkChannelsOn(t, a, 0x00)
+	if got := a.R(nr50Addr); got != 0x00 {
+		t.Errorf("expected NR50 to be cleared, got %02Xh\n", got)
+	}
+	a.W(nr50Addr, 0x77)
+	if got := a.R(nr50Addr); got != 0x00 {
+		t.Errorf("expected NR50 write to be ignored, got %02Xh\n", got)
+	}
+	// Length counters can still be loaded with the power off
+	a.W(nr11Addr, 0x3f)
+	if a.ch1.length.counter != 1 {
+		t.Errorf("expected length counter 1, got %d\n", a.ch1.length.counter)
+	}
+}
+
+func TestAPULengthCounter(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr12Addr, 0xf0)
+	a.W(nr11Addr, 0x3e)
+	a.W(nr14Addr, 0xc0)
+	checkChannelsOn(t, a, 0x01)
+	a.stepFrameSequencer()
+	a.stepFrameSequencer()
+	checkChannelsOn(t, a, 0x01)
+	a.stepFrameSequencer()
+	checkChannelsOn(t, a, 0x00)
+}
+
+func TestAPULengthEnableExtraClock(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr12Addr, 0xf0)
+	a.W(nr11Addr, 0x3f)
+	a.W(nr14Addr, 0x80)
+	// The next step doesn't clock length, so enabling it clocks right away.
+	a.stepFrameSequencer()
+	a.W(nr14Addr, 0x40)
+	checkChannelsOn(t, a, 0x00)
+}
+
+func TestAPUTriggerZeroLength(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr30Addr, 0x80)
+	a.W(nr34Addr, 0x80)
+	if a.ch3.length.counter != 256 {
+		t.Errorf("expected length counter 256, got %d\n", a.ch3.length.counter)
+	}
+}
+
+func TestAPUDACOff(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr22Addr, 0x00)
+	a.W(nr24Addr, 0x80)
+	checkChannelsOn(t, a, 0x00)
+
+	a.W(nr22Addr, 0x08)
+	a.W(nr24Addr, 0x80)
+	checkChannelsOn(t, a, 0x02)
+	a.W(nr22Addr, 0x00)
+	checkChannelsOn(t, a, 0x00)
+}
+
+func TestAPUSweepOverflow(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr12Addr, 0xf0)
+	a.W(nr10Addr, 0x11)
+	a.W(nr13Addr, 0xff)
+	a.W(nr14Addr, 0x87)
+	// The overflow check on trigger should kill it immediately
+	checkChannelsOn(t, a, 0x00)
+
+	a.W(nr13Addr, 0x00)
+	a.W(nr14Addr, 0x84)
+	checkChannelsOn(t, a, 0x01)
+	a.stepFrameSequencer()
+	a.stepFrameSequencer()
+	a.stepFrameSequencer()
+	if f := a.ch1.freq(); f != 0x600 {
+		t.Errorf("expected swept frequency 600h, got %03Xh\n", f)
+	}
+	// The second overflow check looks ahead to 900h
+	checkChannelsOn(t, a, 0x00)
+}
+
+func TestAPUSweepNegateQuirk(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr12Addr, 0xf0)
+	a.W(nr10Addr, 0x19)
+	a.W(nr13Addr, 0x00)
+	a.W(nr14Addr, 0x84)
+	checkChannelsOn(t, a, 0x01)
+	// Leaving negate mode after a negated calculation disables the channel
+	a.W(nr10Addr, 0x11)
+	checkChannelsOn(t, a, 0x00)
+}
+
+func TestAPUEnvelope(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr42Addr, 0x01)
+	a.W(nr44Addr, 0x80)
+	for i := 0; i < 8; i++ {
+		a.stepFrameSequencer()
+	}
+	if a.ch4.env.volume != 0 {
+		t.Errorf("expected volume 0, got %d\n", a.ch4.env.volume)
+	}
+	a.W(nr42Addr, 0xe9)
+	a.W(nr44Addr, 0x80)
+	for i := 0; i < 8; i++ {
+		a.stepFrameSequencer()
+	}
+	if a.ch4.env.volume != 15 {
+		t.Errorf("expected volume 15, got %d\n", a.ch4.env.volume)
+	}
+}
+
+func TestAPUWaveRAM(t *testing.T) {
+	a := poweredAPU()
+	for i := uint16(0); i < 16; i++ {
+		a.W(waveRAMAddr+i, uint8(i*0x11))
+	}
+	for i := uint16(0); i < 16; i++ {
+		if got := a.R(waveRAMAddr + i); got != uint8(i*0x11) {
+			t.Errorf("expected %02Xh in wave RAM, got %02Xh\n", i*0x11, got)
+		}
+	}
+	a.W(nr30Addr, 0x80)
+	a.W(nr32Addr, 0x20)
+	a.W(nr34Addr, 0x80)
+	a.ch3.position = 3
+	if got := a.ch3.output(); got != 0x01 {
+		t.Errorf("expected sample 1h, got %Xh\n", got)
+	}
+	a.W(nr32Addr, 0x40)
+	a.ch3.position = 31
+	if got := a.ch3.output(); got != 0x07 {
+		t.Errorf("expected sample 7h, got %Xh\n", got)
+	}
+}
+
+func TestAPUMix(t *testing.T) {
+	a := poweredAPU()
+	a.W(nr50Addr, 0x77)
+	a.W(nr51Addr, 0x20)
+	a.W(nr22Addr, 0xf0)
+	a.W(nr21Addr, 0xc0)
+	a.W(nr24Addr, 0x80)
+	a.ch2.dutyPos = 1
+	left, right := a.mix()
+	if left != 0.25 {
+		t.Errorf("expected left=0.25, got %f\n", left)
+	}
+	if right != 0 {
+		t.Errorf("expected right=0, got %f\n", right)
+	}
+}
+
+func TestAPUFrameSequencerFollowsDIV(t *testing.T) {
+	s := S([]byte{})
+	start := s.apu.fsStep
+	s.RunCycles(4 * int(clkFreq/512))
+	if s.apu.fsStep != (start+4)%8 {
+		t.Errorf("expected frame sequencer step %d, got %d\n", (start+4)%8, s.apu.fsStep)
+	}
+}
+
+type recordingAudioSink struct {
+	rate    float64
+	samples []float32
+}
+
+func (r *recordingAudioSink) AudioSamples(samples []float32) {
+	r.samples = append(r.samples, samples...)
+}
+
+func (r *recordingAudioSink) SampleRate() float64 {
+	return r.rate
+}
+
+func TestAudioSinkRate(t *testing.T) {
+	s := S([]byte{})
+	sink := &recordingAudioSink{rate: 32768}
+	s.SetAudioSink(sink)
+	s.RunCycles(int(clkFreq) / 4)
+	// Everything short of a full batch is still waiting to be sent
+	frames := len(sink.samples) / 2
+	if frames > 8192 || frames <= 8192-audioBatchSize {
+		t.Errorf("expected about 8192 samples, got %d\n", frames)
+	}
+
+	sink.rate = 16384
+	sink.samples = nil
+	s.RunCycles(int(clkFreq) / 4)
+	frames = len(sink.samples) / 2
+	if frames > 4096+audioBatchSize || frames <= 4096-audioBatchSize {
+		t.Errorf("expected about 4096 samples, got %d\n", frames)
+	}
+}
+
+func TestAudioSinkPoweredOff(t *testing.T) {
+	s := S([]byte{})
+	sink := &recordingAudioSink{rate: 32768}
+	s.SetAudioSink(sink)
+	s.Wb(nr52Addr, 0x00)
+	s.RunCycles(int(clkFreq) / 4)
+	frames := len(sink.samples) / 2
+	if frames > 8192 || frames <= 8192-audioBatchSize {
+		t.Errorf("expected about 8192 samples with the APU off, got %d\n", frames)
+	}
+	for _, v := range sink.samples {
+		if v != 0 {
+			t.Fatalf("expected silence with the APU off, got %f\n", v)
+		}
+	}
+}
+
+func TestAudioSinkZeroRate(t *testing.T) {
+	s := S([]byte{})
+	sink := &recordingAudioSink{rate: 0}
+	s.SetAudioSink(MultiAudioSink(sink, MultiAudioSink()))
+	s.RunCycles(int(clkFreq) / 4)
+	if len(sink.samples) != 0 {
+		t.Errorf("expected no samples at rate 0, got %d\n", len(sink.samples)/2)
+	}
+
+	// And it should pick up again once there's a rate
+	sink.rate = 32768
+	s.RunCycles(int(clkFreq) / 4)
+	frames := len(sink.samples) / 2
+	if frames > 8192 || frames < 8192-audioBatchSize {
+		t.Errorf("expected about 8192 samples, got %d\n", frames)
+	}
+	if rate := MultiAudioSink().SampleRate(); rate != 0 {
+		t.Errorf("expected an empty MultiAudioSink to have rate 0, got %f\n", rate)
+	}
+}
+
+func TestAudioSinkSquareWave(t *testing.T) {
+	s := S([]byte{})
+	sink := &recordingAudioSink{rate: 32768}
+	s.SetAudioSink(sink)
+	// 512Hz 50% square on channel 2, left only
+	s.Wb(nr51Addr, 0x20)
+	s.Wb(nr22Addr, 0xf0)
+	s.Wb(nr21Addr, 0x80)
+	s.Wb(nr23Addr, 0x00)
+	s.Wb(nr24Addr, 0x87)
+	s.RunCycles(int(clkFreq) / 8)
+	var min, max float32
+	for i := 0; i < len(sink.samples); i += 2 {
+		if sink.samples[i+1] != 0 {
+			t.Fatalf("expected silence on the right, got %f\n", sink.samples[i+1])
+		}
+		if sink.samples[i] < min {
+			min = sink.samples[i]
+		}
+		if sink.samples[i] > max {
+			max = sink.samples[i]
+		}
+	}
+	if max < 0.1 || min > -0.1 {
+		t.Errorf("expected a square wave on the left, got %f to %f\n", min, max)
+	}
+}
+
+type apuWrite struct {
+	wall int
+	addr uint16
+	val  uint8
+}
+
+type observingAudioSink struct {
+	recordingAudioSink
+	writes []apuWrite
+}
+
+func (o *observingAudioSink) APUWrite(wall int, addr uint16, val uint8) {
+	o.writes = append(o.writes, apuWrite{wall, addr, val})
+}
+
+func TestAPUWriteObserver(t *testing.T) {
+	s := S([]byte{})
+	s.RunCycles(100)
+	rec := &recordingAudioSink{rate: 32768}
+	obs := &observingAudioSink{recordingAudioSink: recordingAudioSink{rate: 16384}}
+	s.SetAudioSink(MultiAudioSink(rec, obs))
+
+	// Power, wave RAM and then the rest of the registers
+	if len(obs.writes) != 1+16+int(nr52Addr-apuStartAddr) {
+		t.Fatalf("expected a write for every register, got %d\n", len(obs.writes))
+	}
+	if w := obs.writes[0]; w.addr != nr52Addr || w.val != 0x80 {
+		t.Errorf("expected power on first, got %+v\n", w)
+	}
+	for _, w := range obs.writes {
+		if w.addr == nr14Addr && w.val&0x80 != 0 {
+			t.Errorf("expected no trigger in replayed NR14, got %02Xh\n", w.val)
+		}
+	}
+
+	obs.writes = nil
+	s.RunCycles(100)
+	wall := s.Wall
+	s.Wb(nr50Addr, 0x12)
+	if len(obs.writes) != 1 || obs.writes[0] != (apuWrite{wall - 4, nr50Addr, 0x12}) {
+		t.Errorf("expected NR50 write at %d, got %+v\n", wall-4, obs.writes)
+	}
+
+	// Each sink gets samples at its own rate
+	rec.samples, obs.samples = nil, nil
+	s.RunCycles(int(clkFreq) / 8)
+	if frames := len(rec.samples) / 2; frames > 4096+audioBatchSize || frames <= 4096-audioBatchSize {
+		t.Errorf("expected about 4096 samples at 32768Hz, got %d\n", frames)
+	}
+	if frames := len(obs.samples) / 2; frames > 2048+audioBatchSize || frames <= 2048-audioBatchSize {
+		t.Errorf("expected about 2048 samples at 16384Hz, got %d\n", frames)
+	}
+}
+
+func TestAudioChannelMask(t *testing.T) {
+	s := S([]byte{})
+	obs := &observingAudioSink{recordingAudioSink: recordingAudioSink{rate: 32768}}
+	s.SetAudioSink(obs)
+	s.Wb(nr51Addr, 0xff)
+	s.Wb(nr22Addr, 0xf0)
+	s.Wb(nr21Addr, 0xc0)
+	s.Wb(nr24Addr, 0x80)
+	s.apu.ch2.dutyPos = 1
+
+	obs.writes = nil
+	s.SetAudioChannelMask(AllAudioChannels &^ AudioSquare2)
+	if s.AudioChannelMask() != 0x0d {
+		t.Errorf("expected mask 0Dh, got %02Xh\n", s.AudioChannelMask())
+	}
+	if len(obs.writes) != 1 || obs.writes[0].addr != nr51Addr || obs.writes[0].val != 0xdd {
+		t.Errorf("expected masked NR51 write of DDh, got %+v\n", obs.writes)
+	}
+	s.apu.ch1.enabled = false
+	if left, right := s.apu.mix(); left != right || left >= 0 {
+		t.Errorf("expected channel 2 to be muted, got %f %f\n", left, right)
+	}
+
+	s.SetAudioChannelMask(AudioSquare2)
+	if left, right := s.apu.mix(); left != 0.25 || right != 0.25 {
+		t.Errorf("expected only channel 2, got %f %f\n", left, right)
+	}
+	// The game still sees what it wrote
+	if got := s.Rb(nr51Addr); got != 0xff {
+		t.Errorf("expected NR51=FFh, got %02Xh\n", got)
+	}
+}
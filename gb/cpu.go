@@ -26,6 +26,14 @@ type CPU struct {
 
 	halt       bool
 	interrupts bool
+	// Cycles ticked by memory accesses so far this step
+	ticked int
+	// EI takes effect after the instruction following it. This counts down
+	// the instructions until it does.
+	eiDelay int
+	// HALT with interrupts disabled but one already pending doesn't halt,
+	// instead the next opcode is read without the PC moving past it.
+	haltBug bool
 }
 
 func (c *CPU) flags() uint8 {
@@ -181,27 +189,61 @@ func (c *CPU) cond(con CPUCond) bool {
 }
 
 func (c *CPU) Step(sys *Sys) int {
-	if c.interrupts {
-		interrupt := sys.HandleInterrupt()
-		if interrupt != nil {
-			if c.halt {
-				fmt.Printf("HALT ended\n")
-			}
-			c.halt = false
-			c.interrupts = false
-			addr := uint16(0x40 + 8*uint(*interrupt))
-			return RST(addr, true)(c, sys)
+	c.ticked = 0
+	if sys.InterruptPending() {
+		// Any pending interrupt ends HALT, even if we aren't going to
+		// service it.
+		c.halt = false
+		if c.interrupts {
+			return c.dispatchInterrupt(sys)
 		}
 	}
 	if c.halt {
 		return 4
 	}
-	opcode := sys.Rb(c.ip)
+	opcode := c.rb(sys, c.ip)
+	if sys.opcodeHook != nil {
+		sys.opcodeHook(sys, c.ip, opcode)
+	}
+	if c.haltBug {
+		// Every op reads its operands starting from ip+1, so backing up
+		// one makes the opcode byte get read again as the first operand
+		// (or as the opcode again for one byte instructions).
+		c.haltBug = false
+		c.ip--
+	}
+	var cycles int
 	if opcode == 0xcb {
-		opcode = sys.Rb(c.ip + 1)
-		return cbops[opcode](c, sys)
+		opcode = c.rb(sys, c.ip+1)
+		cycles = cbops[opcode](c, sys)
+	} else {
+		cycles = ops[opcode](c, sys)
 	}
-	return ops[opcode](c, sys)
+	if c.eiDelay > 0 {
+		c.eiDelay--
+		if c.eiDelay == 0 {
+			c.interrupts = true
+		}
+	}
+	return cycles
+}
+
+// Push the PC and jump to the highest priority interrupt's handler.
+func (c *CPU) dispatchInterrupt(sys *Sys) int {
+	c.tick(sys)
+	interrupt := sys.HandleInterrupt()
+	c.interrupts = false
+	c.eiDelay = 0
+	ra := c.ip
+	if c.haltBug {
+		// EI right before a HALT with an interrupt pending returns to
+		// the HALT.
+		c.haltBug = false
+		ra--
+	}
+	c.Push(sys, ra)
+	c.ip = uint16(0x40 + 8*uint(*interrupt))
+	return 20
 }
 
 func (c *CPU) State(sys *Sys) string {
@@ -244,6 +286,20 @@ func (c *CPU) State(sys *Sys) string {
 	return o.String()
 }
 
+func (c *CPU) saveState(w *stateWriter) {
+	w.write(c.b, c.c, c.d, c.e, c.h, c.l, c.a, c.ip, c.sp)
+	w.write(c.fz, c.fn, c.fh, c.fc, c.halt, c.interrupts)
+	w.write(int32(c.eiDelay), c.haltBug)
+}
+
+func (c *CPU) loadState(r *stateReader) {
+	r.read(&c.b, &c.c, &c.d, &c.e, &c.h, &c.l, &c.a, &c.ip, &c.sp)
+	r.read(&c.fz, &c.fn, &c.fh, &c.fc, &c.halt, &c.interrupts)
+	var eiDelay int32
+	r.read(&eiDelay, &c.haltBug)
+	c.eiDelay = int(eiDelay)
+}
+
 type ByteRegister int
 
 const (
@@ -373,17 +429,60 @@ func (c *CPU) wrs(sr ShortRegister, v uint16) {
 	}
 }
 
+// Pushes always take an internal cycle first, then write the high byte.
 func (c *CPU) Push(sys *Sys, v uint16) {
-	c.sp -= 2
-	sys.Ws(c.sp, v)
+	c.tick(sys)
+	c.sp--
+	c.wb(sys, c.sp, uint8(v>>8))
+	c.sp--
+	c.wb(sys, c.sp, uint8(v))
 }
 
 func (c *CPU) Pop(sys *Sys) uint16 {
-	rv := sys.Rs(c.sp)
+	rv := c.rs(sys, c.sp)
 	c.sp += 2
 	return rv
 }
 
+/*
+ * Everything else on the bus runs one machine cycle (4 clock cycles) per CPU
+ * memory access, right before the access happens. Instructions that take
+ * longer than their accesses account for have the rest ticked off by
+ * Sys.Step once they're done.
+ */
+func (c *CPU) tick(sys *Sys) {
+	sys.tick()
+	c.ticked += 4
+}
+
+// While OAM DMA is running reads from most of the bus see 0xff and writes
+// go nowhere.
+func (c *CPU) rb(sys *Sys, addr uint16) uint8 {
+	c.tick(sys)
+	if sys.video.dmaBlocks(addr) {
+		return 0xff
+	}
+	return sys.Rb(addr)
+}
+
+func (c *CPU) wb(sys *Sys, addr uint16, val uint8) {
+	c.tick(sys)
+	if sys.video.dmaBlocks(addr) {
+		return
+	}
+	sys.Wb(addr, val)
+}
+
+func (c *CPU) rs(sys *Sys, addr uint16) uint16 {
+	lo := c.rb(sys, addr)
+	return uint16(lo) | uint16(c.rb(sys, addr+1))<<8
+}
+
+func (c *CPU) ws(sys *Sys, addr uint16, val uint16) {
+	c.wb(sys, addr, uint8(val))
+	c.wb(sys, addr+1, uint8(val>>8))
+}
+
 type OpFunc func(cpu *CPU, sys *Sys) int
 
 func NOP(cpu *CPU, sys *Sys) int {
@@ -402,7 +501,7 @@ func STOP(cpu *CPU, sys *Sys) int {
 /* Load short immediate */
 func LDSImm(sr ShortRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		cpu.wrs(sr, sys.Rs(cpu.ip+1))
+		cpu.wrs(sr, cpu.rs(sys, cpu.ip+1))
 		cpu.ip += 3
 		return 12
 	}
@@ -412,7 +511,7 @@ func LDSImm(sr ShortRegister) OpFunc {
 func LDARegInd(br ShortRegister, mod int) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		addr := cpu.rrs(br)
-		sys.Wb(addr, cpu.rrb(A))
+		cpu.wb(sys, addr, cpu.rrb(A))
 		if mod == 1 {
 			cpu.wrs(br, addr+1)
 		} else if mod == -1 {
@@ -441,9 +540,9 @@ func INCDECB(br ByteRegister, mod int) OpFunc {
 		var v uint8
 		var newVal uint8
 		if br == HLind {
-			v = sys.Rb(cpu.rrs(HL))
+			v = cpu.rb(sys, cpu.rrs(HL))
 			newVal = uint8(int(v) + mod)
-			sys.Wb(cpu.rrs(HL), newVal)
+			cpu.wb(sys, cpu.rrs(HL), newVal)
 		} else {
 			v = cpu.rrb(br)
 			newVal = uint8(int(v) + mod)
@@ -467,7 +566,7 @@ func INCDECB(br ByteRegister, mod int) OpFunc {
 
 func JR(con CPUCond) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		j := signExtend(sys.Rb(cpu.ip + 1))
+		j := signExtend(cpu.rb(sys, cpu.ip+1))
 		duration := 0
 		/* The relative amount is relative to where we would have been after this op */
 		cpu.ip += 2
@@ -486,10 +585,10 @@ func LDBImm(br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		duration := 0
 		if br == HLind {
-			sys.Wb(cpu.rrs(HL), sys.Rb(cpu.ip+1))
+			cpu.wb(sys, cpu.rrs(HL), cpu.rb(sys, cpu.ip+1))
 			duration = 12
 		} else {
-			cpu.wrb(br, sys.Rb(cpu.ip+1))
+			cpu.wrb(br, cpu.rb(sys, cpu.ip+1))
 			duration = 8
 		}
 		cpu.ip += 2
@@ -535,8 +634,8 @@ func RLA(cpu *CPU, sys *Sys) int {
 /* Load SP via an imediate value that points to another value */
 func LDSPImmInd(cpu *CPU, sys *Sys) int {
 	sp := cpu.rrs(SP)
-	addr := sys.Rs(cpu.ip + 1)
-	sys.Ws(addr, sp)
+	addr := cpu.rs(sys, cpu.ip+1)
+	cpu.ws(sys, addr, sp)
 
 	cpu.ip += 3
 	return 20
@@ -562,7 +661,7 @@ func ADDS(sr ShortRegister) OpFunc {
 func LDBInd(destReg ByteRegister, srcAddrReg ShortRegister, mod int) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		addr := cpu.rrs(srcAddrReg)
-		cpu.wrb(destReg, sys.Rb(addr))
+		cpu.wrb(destReg, cpu.rb(sys, addr))
 		if mod != 0 {
 			cpu.wrs(srcAddrReg, uint16(int(addr)+mod))
 		}
@@ -689,7 +788,7 @@ func LDHLBindir(br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		val := cpu.rrb(br)
 		addr := cpu.rrs(HL)
-		sys.Wb(addr, val)
+		cpu.wb(sys, addr, val)
 
 		cpu.ip++
 		return 8
@@ -697,8 +796,11 @@ func LDHLBindir(br ByteRegister) OpFunc {
 }
 
 func HALT(cpu *CPU, sys *Sys) int {
-	fmt.Printf("HALT started\n")
-	cpu.halt = true
+	if !cpu.interrupts && sys.InterruptPending() {
+		cpu.haltBug = true
+	} else {
+		cpu.halt = true
+	}
 
 	cpu.ip++
 	return 4
@@ -710,11 +812,11 @@ func ALU(op ALUOp, br ByteRegister) OpFunc {
 		var duration int
 		var iSize uint16
 		if br == HLind {
-			val = sys.Rb(cpu.rrs(HL))
+			val = cpu.rb(sys, cpu.rrs(HL))
 			duration = 8
 			iSize = 1
 		} else if br == Imm {
-			val = sys.Rb(cpu.ip + 1)
+			val = cpu.rb(sys, cpu.ip+1)
 			duration = 8
 			iSize = 2
 		} else {
@@ -799,6 +901,11 @@ func RET(con CPUCond, enableInterrupts bool) OpFunc {
 		if enableInterrupts {
 			cpu.interrupts = true
 		}
+		// Conditional returns spend a cycle checking the condition before
+		// they pop anything
+		if con != condNone {
+			cpu.tick(sys)
+		}
 		if cpu.cond(con) {
 			ra := cpu.Pop(sys)
 			cpu.ip = ra
@@ -815,7 +922,7 @@ func RET(con CPUCond, enableInterrupts bool) OpFunc {
 
 func JP(con CPUCond) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		addr := sys.Rs(cpu.ip + 1)
+		addr := cpu.rs(sys, cpu.ip+1)
 		if cpu.cond(con) {
 			cpu.ip = addr
 			return 16
@@ -828,7 +935,7 @@ func JP(con CPUCond) OpFunc {
 
 func CALL(con CPUCond) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		addr := sys.Rs(cpu.ip + 1)
+		addr := cpu.rs(sys, cpu.ip+1)
 		if cpu.cond(con) {
 			cpu.Push(sys, cpu.ip+3)
 			cpu.ip = addr
@@ -881,13 +988,9 @@ func PUSH(sr ShortRegister) OpFunc {
 	}
 }
 
-func RST(addr uint16, fromInterrupt bool) OpFunc {
+func RST(addr uint16) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		ra := cpu.ip
-		if !fromInterrupt {
-			ra += 1
-		}
-		cpu.Push(sys, ra)
+		cpu.Push(sys, cpu.ip+1)
 		cpu.ip = addr
 
 		return 16
@@ -908,11 +1011,11 @@ func DRAGONS(cpu *CPU, sys *Sys) int {
 
 func LDH(atoaddr bool) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		addr := uint16(0xff00) | uint16(sys.Rb(cpu.ip+1))
+		addr := uint16(0xff00) | uint16(cpu.rb(sys, cpu.ip+1))
 		if atoaddr {
-			sys.Wb(addr, cpu.a)
+			cpu.wb(sys, addr, cpu.a)
 		} else {
-			cpu.a = sys.Rb(addr)
+			cpu.a = cpu.rb(sys, addr)
 		}
 
 		cpu.ip += 2
@@ -924,9 +1027,9 @@ func LDHC(atoaddr bool) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		addr := uint16(0xff00) | uint16(cpu.c)
 		if atoaddr {
-			sys.Wb(addr, cpu.a)
+			cpu.wb(sys, addr, cpu.a)
 		} else {
-			cpu.a = sys.Rb(addr)
+			cpu.a = cpu.rb(sys, addr)
 		}
 
 		cpu.ip++
@@ -935,7 +1038,7 @@ func LDHC(atoaddr bool) OpFunc {
 }
 
 func ADDSPimm(cpu *CPU, sys *Sys) int {
-	v := signExtend(sys.Rb(cpu.ip + 1))
+	v := signExtend(cpu.rb(sys, cpu.ip+1))
 
 	cpu.fz = false
 	cpu.fn = false
@@ -950,11 +1053,11 @@ func ADDSPimm(cpu *CPU, sys *Sys) int {
 
 func LDSimmAddr(atoaddr bool) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
-		addr := sys.Rs(cpu.ip + 1)
+		addr := cpu.rs(sys, cpu.ip+1)
 		if atoaddr {
-			sys.Wb(addr, cpu.a)
+			cpu.wb(sys, addr, cpu.a)
 		} else {
-			cpu.a = sys.Rb(addr)
+			cpu.a = cpu.rb(sys, addr)
 		}
 
 		cpu.ip += 3
@@ -964,20 +1067,24 @@ func LDSimmAddr(atoaddr bool) OpFunc {
 
 func DI(cpu *CPU, sys *Sys) int {
 	cpu.interrupts = false
+	cpu.eiDelay = 0
 
 	cpu.ip++
 	return 4
 }
 
 func EI(cpu *CPU, sys *Sys) int {
-	cpu.interrupts = true
+	// Counting this instruction and the next one
+	if !cpu.interrupts {
+		cpu.eiDelay = 2
+	}
 
 	cpu.ip++
 	return 4
 }
 
 func LDHLSPimm(cpu *CPU, sys *Sys) int {
-	v := signExtend(sys.Rb(cpu.ip + 1))
+	v := signExtend(cpu.rb(sys, cpu.ip+1))
 
 	cpu.fz = false
 	cpu.fn = false
@@ -1014,7 +1121,7 @@ func CBR(op CBROp, br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		var v uint8
 		if br == HLind {
-			v = sys.Rb(cpu.rrs(HL))
+			v = cpu.rb(sys, cpu.rrs(HL))
 		} else {
 			v = cpu.rrb(br)
 		}
@@ -1062,7 +1169,7 @@ func CBR(op CBROp, br ByteRegister) OpFunc {
 			panic("invalid op!")
 		}
 		if br == HLind {
-			sys.Wb(cpu.rrs(HL), v)
+			cpu.wb(sys, cpu.rrs(HL), v)
 		} else {
 			cpu.wrb(br, v)
 		}
@@ -1083,14 +1190,14 @@ func SWAP(br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		var v uint8
 		if br == HLind {
-			v = sys.Rb(cpu.rrs(HL))
+			v = cpu.rb(sys, cpu.rrs(HL))
 		} else {
 			v = cpu.rrb(br)
 		}
 
 		v = v>>4 | v<<4
 		if br == HLind {
-			sys.Wb(cpu.rrs(HL), v)
+			cpu.wb(sys, cpu.rrs(HL), v)
 		} else {
 			cpu.wrb(br, v)
 		}
@@ -1112,7 +1219,7 @@ func BIT(n uint, br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		var v uint8
 		if br == HLind {
-			v = sys.Rb(cpu.rrs(HL))
+			v = cpu.rb(sys, cpu.rrs(HL))
 		} else {
 			v = cpu.rrb(br)
 		}
@@ -1122,8 +1229,9 @@ func BIT(n uint, br ByteRegister) OpFunc {
 		cpu.fh = true
 
 		cpu.ip += 2
+		// Only reads (HL), so there's no write cycle
 		if br == HLind {
-			return 16
+			return 12
 		}
 		return 8
 	}
@@ -1133,7 +1241,7 @@ func SETRES(set bool, n uint, br ByteRegister) OpFunc {
 	return func(cpu *CPU, sys *Sys) int {
 		var v uint8
 		if br == HLind {
-			v = sys.Rb(cpu.rrs(HL))
+			v = cpu.rb(sys, cpu.rrs(HL))
 		} else {
 			v = cpu.rrb(br)
 		}
@@ -1145,7 +1253,7 @@ func SETRES(set bool, n uint, br ByteRegister) OpFunc {
 		}
 
 		if br == HLind {
-			sys.Wb(cpu.rrs(HL), v)
+			cpu.wb(sys, cpu.rrs(HL), v)
 		} else {
 			cpu.wrb(br, v)
 		}
@@ -1371,7 +1479,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	CALL(condNZ),         /* CALL NZ,a16 */
 	PUSH(BC),             /* PUSH BC */
 	ALU(ADD, Imm),        /* ADD A,d8 */
-	RST(0x00, false),     /* RST 00H */
+	RST(0x00),            /* RST 00H */
 	RET(condZ, false),    /* RET Z */
 	RET(condNone, false), /* RET */
 	JP(condZ),            /* JP Z,a16 */
@@ -1379,7 +1487,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	CALL(condZ),          /* CALL Z,a16 */
 	CALL(condNone),       /* CALL a16 */
 	ALU(ADC, Imm),        /* ADC A,d8 */
-	RST(0x08, false),     /* RST 08H */
+	RST(0x08),            /* RST 08H */
 	/* 0xd0 */
 	RET(condNC, false),  /* RET NC */
 	POP(DE),             /* POP DE */
@@ -1388,7 +1496,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	CALL(condNC),        /* CALL NC,a16 */
 	PUSH(DE),            /* PUSH DE */
 	ALU(SUB, Imm),       /* SUB A,d8 */
-	RST(0x10, false),    /* RST 10H */
+	RST(0x10),           /* RST 10H */
 	RET(condC, false),   /* RET C */
 	RET(condNone, true), /* RETI */
 	JP(condC),           /* JP C,a16 */
@@ -1396,7 +1504,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	CALL(condC),         /* CALL C,a16 */
 	DRAGONS,             /* XXX */
 	ALU(SBC, Imm),       /* SBC A,d8 */
-	RST(0x18, false),    /* RST 18H */
+	RST(0x18),           /* RST 18H */
 	/* 0xe0 */
 	LDH(true),        /* LDH (a8),A */
 	POP(HL),          /* POP HL */
@@ -1405,7 +1513,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	DRAGONS,          /* XXX */
 	PUSH(HL),         /* PUSH HL */
 	ALU(AND, Imm),    /* AND A,d8 */
-	RST(0x20, false), /* RST 20H */
+	RST(0x20),        /* RST 20H */
 	ADDSPimm,         /* ADD SP,r8 */
 	JPHLind,          /* JP (HL) */
 	LDSimmAddr(true), /* LD (a16),A */
@@ -1413,7 +1521,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	DRAGONS,          /* XXX */
 	DRAGONS,          /* XXX */
 	ALU(XOR, Imm),    /* XOR A,d8 */
-	RST(0x28, false), /* RST 28H */
+	RST(0x28),        /* RST 28H */
 	/* 0xf0 */
 	LDH(false),        /* LDH A,(a8) */
 	POPAF,             /* POP AF */
@@ -1422,7 +1530,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	DRAGONS,           /* XXX */
 	PUSH(AF),          /* PUSH AF */
 	ALU(OR, Imm),      /* OR A,d8 */
-	RST(0x30, false),  /* RST 30H */
+	RST(0x30),         /* RST 30H */
 	LDHLSPimm,         /* LD HL,SP+r8 */
 	LDSPHL,            /* LD SP,HL */
 	LDSimmAddr(false), /* LD A,(a16) */
@@ -1430,7 +1538,7 @@ var ops [0x100]OpFunc = [0x100]OpFunc{
 	DRAGONS,           /* XXX */
 	DRAGONS,           /* XXX */
 	ALU(CP, Imm),      /* CP A,d8 */
-	RST(0x38, false),  /* RST 38H */
+	RST(0x38),         /* RST 38H */
 }
 
 var cbops [0x100]OpFunc = [0x100]OpFunc{
@@ -926,3 +926,213 @@ func TestLD8Bit(t *testing.T) {
 	checkIP(t, s, 0x13f)
 	checkBr(t, s, A, 7)
 }
+
+func TestInterruptDispatch(t *testing.T) {
+	s := S([]byte{0x00})
+	s.cpu.interrupts = true
+	s.ieReg.set(0x05)
+	s.ifReg.set(0x04)
+
+	checkStep(t, s, 20)
+	checkIP(t, s, 0x50)
+	checkSP(t, s, 0xcffd)
+	checkRb(t, s, 0xcffd, 0x00)
+	checkRb(t, s, 0xcffe, 0x01)
+	if s.ifReg.val() != 0x00 || s.cpu.interrupts {
+		t.Errorf("expected IF to be acknowledged and IME cleared\n")
+	}
+}
+
+func TestEIDelay(t *testing.T) {
+	s := S([]byte{
+		0xfb, // EI
+		0x00, // NOP
+		0x00, // NOP
+	})
+	s.ieReg.set(0x01)
+	s.ifReg.set(0x01)
+
+	checkStep(t, s, 4) // EI
+	checkIP(t, s, 0x101)
+	// The instruction after EI always runs
+	checkStep(t, s, 4) // NOP
+	checkIP(t, s, 0x102)
+	checkStep(t, s, 20)
+	checkIP(t, s, 0x40)
+}
+
+func TestEIDI(t *testing.T) {
+	s := S([]byte{
+		0xfb, // EI
+		0xf3, // DI
+		0x00, // NOP
+	})
+	s.ieReg.set(0x01)
+	s.ifReg.set(0x01)
+
+	checkStep(t, s, 4) // EI
+	checkStep(t, s, 4) // DI
+	checkStep(t, s, 4) // NOP
+	checkIP(t, s, 0x103)
+}
+
+func TestHALTWakesWithoutIME(t *testing.T) {
+	s := S([]byte{
+		0x76, // HALT
+		0x3c, // INC A
+	})
+	s.ieReg.set(0x01)
+
+	checkStep(t, s, 4) // HALT
+	checkStep(t, s, 4)
+	checkIP(t, s, 0x101)
+	checkBr(t, s, A, 0x01)
+
+	// Wakes up and carries on without servicing the interrupt
+	s.ifReg.set(0x01)
+	checkStep(t, s, 4) // INC A
+	checkIP(t, s, 0x102)
+	checkBr(t, s, A, 0x02)
+	if s.ifReg.val() != 0x01 {
+		t.Errorf("expected IF to be left alone\n")
+	}
+}
+
+func TestHALTBug(t *testing.T) {
+	s := S([]byte{
+		0x76,       // HALT
+		0x3c,       // INC A
+		0x06, 0x42, // LD B,d8
+	})
+	s.ieReg.set(0x01)
+	s.ifReg.set(0x01)
+
+	checkStep(t, s, 4) // HALT, which doesn't halt
+	checkStep(t, s, 4) // INC A without moving the PC
+	checkIP(t, s, 0x101)
+	checkStep(t, s, 4) // INC A
+	checkIP(t, s, 0x102)
+	checkBr(t, s, A, 0x03)
+	checkStep(t, s, 8) // LD B,d8
+	checkBr(t, s, B, 0x42)
+
+	// With an operand, the opcode gets read again as the operand
+	s = S([]byte{
+		0x76,       // HALT
+		0x06, 0x42, // LD B,d8
+	})
+	s.ieReg.set(0x01)
+	s.ifReg.set(0x01)
+	checkStep(t, s, 4) // HALT
+	checkStep(t, s, 8) // LD B,06h
+	checkBr(t, s, B, 0x06)
+	checkIP(t, s, 0x102)
+}
+
+func TestHALTAfterEI(t *testing.T) {
+	s := S([]byte{
+		0xfb, // EI
+		0x76, // HALT
+	})
+	s.ieReg.set(0x01)
+	s.ifReg.set(0x01)
+
+	checkStep(t, s, 4) // EI
+	checkStep(t, s, 4) // HALT
+	checkStep(t, s, 20)
+	// The handler returns to the HALT
+	checkRb(t, s, 0xcffd, 0x01)
+	checkRb(t, s, 0xcffe, 0x01)
+}
+
+/*
+ * M-cycles for each opcode, with branches not taken, from the tables in
+ * blargg's instr_timing test. 0 is for the ones that test leaves out: STOP,
+ * HALT, the CB prefix and the opcodes that lock up the CPU.
+ */
+var instrTimes = [256]int{
+	1, 3, 2, 2, 1, 1, 2, 1, 5, 2, 2, 2, 1, 1, 2, 1,
+	0, 3, 2, 2, 1, 1, 2, 1, 3, 2, 2, 2, 1, 1, 2, 1,
+	2, 3, 2, 2, 1, 1, 2, 1, 2, 2, 2, 2, 1, 1, 2, 1,
+	2, 3, 2, 2, 3, 3, 3, 1, 2, 2, 2, 2, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	2, 2, 2, 2, 2, 2, 0, 2, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1,
+	2, 3, 3, 4, 3, 4, 2, 4, 2, 4, 3, 0, 3, 6, 2, 4,
+	2, 3, 3, 0, 3, 4, 2, 4, 2, 4, 3, 0, 3, 0, 2, 4,
+	3, 3, 2, 0, 0, 4, 2, 4, 4, 1, 4, 0, 0, 0, 2, 4,
+	3, 3, 2, 1, 0, 4, 2, 4, 3, 2, 4, 1, 0, 0, 2, 4,
+}
+
+// Extra M-cycles a conditional branch takes when it's taken.
+var instrTakenTimes = map[uint8]int{
+	0x20: 1, 0x28: 1, 0x30: 1, 0x38: 1, // JR cc
+	0xc0: 3, 0xc8: 3, 0xd0: 3, 0xd8: 3, // RET cc
+	0xc2: 1, 0xca: 1, 0xd2: 1, 0xda: 1, // JP cc
+	0xc4: 3, 0xcc: 3, 0xd4: 3, 0xdc: 3, // CALL cc
+}
+
+// M-cycles for a CB prefixed opcode, prefix included.
+func cbInstrTime(op uint8) int {
+	switch {
+	case op&0x07 != 0x06:
+		return 2
+	case op >= 0x40 && op < 0x80:
+		// BIT only reads (HL)
+		return 3
+	}
+	return 4
+}
+
+// Run the instruction at 0100h on a flat bus with the given flags and
+// return how many M-cycles it took.
+func instrCycles(code []byte, flags uint8) int {
+	sys, bus := flatSys()
+	copy(bus.mem[0x100:], code)
+	sys.cpu.ip = 0x100
+	sys.cpu.sp = 0xd000
+	sys.cpu.setFlags(flags)
+	start := sys.Wall
+	sys.Step()
+	return (sys.Wall - start) / 4
+}
+
+func TestInstrTiming(t *testing.T) {
+	for i := 0; i < 0x100; i++ {
+		op := uint8(i)
+		if instrTimes[op] == 0 {
+			continue
+		}
+		extra, conditional := instrTakenTimes[op]
+		// Bit 3 picks Z or C, bit 4 which of them, and bit 3 says
+		// whether the branch wants it set
+		flag := uint8(0x80)
+		if op&0x10 != 0 {
+			flag = 0x10
+		}
+		notTaken, taken := flag, uint8(0)
+		if op&0x08 != 0 {
+			notTaken, taken = 0, flag
+		}
+		if got := instrCycles([]byte{op}, notTaken); got != instrTimes[op] {
+			t.Errorf("expected opcode %02Xh to take %d cycles, got %d\n", op, instrTimes[op], got)
+		}
+		if !conditional {
+			continue
+		}
+		if got := instrCycles([]byte{op}, taken); got != instrTimes[op]+extra {
+			t.Errorf("expected opcode %02Xh to take %d cycles when taken, got %d\n", op, instrTimes[op]+extra, got)
+		}
+	}
+	for i := 0; i < 0x100; i++ {
+		op := uint8(i)
+		if got := instrCycles([]byte{0xcb, op}, 0); got != cbInstrTime(op) {
+			t.Errorf("expected opcode CB %02Xh to take %d cycles, got %d\n", op, cbInstrTime(op), got)
+		}
+	}
+}
@@ -42,6 +42,18 @@ func (j *Joypad) UpdateButtons(sys *Sys, state ButtonState) {
 	}
 }
 
+func (j *Joypad) saveState(w *stateWriter) {
+	j.Lock()
+	defer j.Unlock()
+	w.write(j.val, j.state)
+}
+
+func (j *Joypad) loadState(r *stateReader) {
+	j.Lock()
+	defer j.Unlock()
+	r.read(&j.val, &j.state)
+}
+
 func (j *Joypad) value() uint8 {
 	// Set initial input select values (only bits 4,5 should be set/reset)
 	v := j.val
@@ -0,0 +1,111 @@
+package gb
+
+import (
+	"io"
+)
+
+/*
+ * A MemoryBankController sits between the bus and the cartridge and handles
+ * every access to the ROM area (0000-7FFF) and cartridge RAM area
+ * (A000-BFFF). Writes to the ROM area are how games talk to the controller,
+ * so the controller is free to interpret them however it likes.
+ */
+type MemoryBankController interface {
+	R(addr uint16) uint8
+	W(addr uint16, val uint8)
+}
+
+// Builds a controller for the given cartridge. The controller should use
+// rom.Bank and rom.RAM to get at the cartridge contents.
+type MBCFactory func(rom *ROM) MemoryBankController
+
+// Factories keyed by the cartridge type byte in the header (0147h).
+var mbcFactories map[byte]MBCFactory = map[byte]MBCFactory{
+	0x00: newNoMBC, // ROM ONLY
+	0x01: newMBC1,  // MBC1
+	0x02: newMBC1,  // MBC1+RAM
+	0x03: newMBC1,  // MBC1+RAM+BATTERY
+	0x05: newMBC2,  // MBC2
+	0x06: newMBC2,  // MBC2+BATTERY
+	0x08: newNoMBC, // ROM+RAM
+	0x09: newNoMBC, // ROM+RAM+BATTERY
+	0x0f: newMBC3,  // MBC3+TIMER+BATTERY
+	0x10: newMBC3,  // MBC3+TIMER+RAM+BATTERY
+	0x11: newMBC3,  // MBC3
+	0x12: newMBC3,  // MBC3+RAM
+	0x13: newMBC3,  // MBC3+RAM+BATTERY
+	0x19: newMBC5,  // MBC5
+	0x1a: newMBC5,  // MBC5+RAM
+	0x1b: newMBC5,  // MBC5+RAM+BATTERY
+	0x1c: newMBC5,  // MBC5+RUMBLE
+	0x1d: newMBC5,  // MBC5+RUMBLE+RAM
+	0x1e: newMBC5,  // MBC5+RUMBLE+RAM+BATTERY
+}
+
+/*
+ * Register a factory for a cartridge type, replacing any existing one. This
+ * lets code outside this package support boards we don't know about. Nothing
+ * guards the table, so call it from an init function, or at least before
+ * anything loads a ROM, and never alongside LoadROM.
+ */
+func RegisterMBC(cartType byte, factory MBCFactory) {
+	mbcFactories[cartType] = factory
+}
+
+// Cartridges without a controller just map the first two banks straight
+// through, along with up to 8k of RAM.
+type noMBC struct {
+	rom *ROM
+}
+
+func newNoMBC(rom *ROM) MemoryBankController {
+	return &noMBC{rom}
+}
+
+func (m *noMBC) R(addr uint16) uint8 {
+	if addr < 0x8000 {
+		return m.rom.Bank(int(addr) / int(bankSize))[uint(addr)%bankSize]
+	}
+	ram := m.rom.RAM()
+	if len(ram) == 0 {
+		return 0xff
+	}
+	return ram[uint(addr-0xa000)%uint(len(ram))]
+}
+
+func (m *noMBC) W(addr uint16, val uint8) {
+	ram := m.rom.RAM()
+	if addr < 0xa000 || len(ram) == 0 {
+		return
+	}
+	ram[uint(addr-0xa000)%uint(len(ram))] = val
+	m.rom.MarkRAMDirty()
+}
+
+// Controllers implement this to have their registers included in save states.
+// Controllers that don't will keep whatever state they had when one is loaded.
+type StatefulMBC interface {
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// Controllers with hardware that runs off the system clock can implement this
+// to be stepped along with the rest of the system.
+type ClockedMBC interface {
+	Step(cycles int)
+}
+
+// Controllers with state besides RAM that should survive a power cycle (like
+// a real-time clock) can implement this to have it stored after the RAM in
+// battery saves.
+type BatteryBackedMBC interface {
+	MarshalBattery() []byte
+	UnmarshalBattery(b []byte) error
+}
+
+// Controllers can implement this to say whether their board has a battery,
+// which is how boards added with RegisterMBC get their RAM saved. Otherwise
+// it's decided by the cartridge type byte.
+type BatteryMBC interface {
+	HasBattery() bool
+}
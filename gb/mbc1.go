@@ -0,0 +1,123 @@
+package gb
+
+import (
+	"bytes"
+	"io"
+)
+
+type mbc1 struct {
+	rom         *ROM
+	multicart   bool
+	ramEnabled  bool
+	bankLow     uint8 // 2000-3FFF
+	bankHigh    uint8 // 4000-5FFF
+	bankingMode uint8 // 6000-7FFF
+}
+
+func newMBC1(rom *ROM) MemoryBankController {
+	return &mbc1{
+		rom:       rom,
+		multicart: isMulticart(rom),
+		bankLow:   1,
+	}
+}
+
+/*
+ * MBC1M multicarts are wired with the upper bank bits shifted down by one, so
+ * each game sees sixteen banks. They don't have a distinct header value, so
+ * detect them the same way everyone else does: a 1MB ROM with a second
+ * Nintendo logo at the start of the second game (bank 0x10).
+ */
+func isMulticart(rom *ROM) bool {
+	if rom.NumBanks() != 64 {
+		return false
+	}
+	logo := rom.Bank(0x10)[0x0104 : 0x0104+len(expectedLogo)]
+	return bytes.Equal(logo, expectedLogo)
+}
+
+func (m *mbc1) SaveState(w io.Writer) error {
+	sw := &stateWriter{w: w}
+	sw.write(m.ramEnabled, m.bankLow, m.bankHigh, m.bankingMode)
+	return sw.err
+}
+
+func (m *mbc1) LoadState(r io.Reader) error {
+	sr := &stateReader{r: r}
+	sr.read(&m.ramEnabled, &m.bankLow, &m.bankHigh, &m.bankingMode)
+	return sr.err
+}
+
+// The number of bits the 4000-5FFF register is shifted by when forming a ROM
+// bank number.
+func (m *mbc1) highShift() uint {
+	if m.multicart {
+		return 4
+	}
+	return 5
+}
+
+// The ROM bank currently mapped into 0000-3FFF. This is always bank 0 unless
+// we're in advanced banking mode, where the upper bits apply here too.
+func (m *mbc1) zeroBank() int {
+	if m.bankingMode == 0 {
+		return 0
+	}
+	return int(m.bankHigh) << m.highShift()
+}
+
+// The ROM bank currently mapped into 4000-7FFF.
+func (m *mbc1) highBank() int {
+	low := m.bankLow
+	if m.multicart {
+		low &= 0x0f
+	}
+	return int(m.bankHigh)<<m.highShift() | int(low)
+}
+
+// Offset into cartridge RAM for an address in A000-BFFF. The upper bank bits
+// only select the RAM bank in advanced banking mode.
+func (m *mbc1) ramOffset(addr uint16) uint {
+	bank := uint(0)
+	if m.bankingMode == 1 {
+		bank = uint(m.bankHigh)
+	}
+	return (bank*ramBankSize + uint(addr-0xa000)) % uint(len(m.rom.RAM()))
+}
+
+func (m *mbc1) R(addr uint16) uint8 {
+	switch {
+	case addr < 0x4000:
+		return m.rom.Bank(m.zeroBank())[addr]
+	case addr < 0x8000:
+		return m.rom.Bank(m.highBank())[addr-0x4000]
+	}
+	if !m.ramEnabled || len(m.rom.RAM()) == 0 {
+		return 0xff
+	}
+	return m.rom.RAM()[m.ramOffset(addr)]
+}
+
+func (m *mbc1) W(addr uint16, val uint8) {
+	switch {
+	case addr < 0x2000:
+		m.ramEnabled = val&0x0f == 0x0a
+	case addr < 0x4000:
+		// The zero check happens on the full five bits, which is why
+		// banks 20h, 40h and 60h end up as 21h, 41h and 61h.
+		m.bankLow = val & 0x1f
+		if m.bankLow == 0 {
+			m.bankLow = 1
+		}
+	case addr < 0x6000:
+		m.bankHigh = val & 0x03
+	case addr < 0x8000:
+		m.bankingMode = val & 0x01
+	case addr >= 0xa000 && addr < 0xc000:
+		if !m.ramEnabled || len(m.rom.RAM()) == 0 {
+			return
+		}
+		m.rom.RAM()[m.ramOffset(addr)] = val
+		m.rom.MarkRAMDirty()
+	}
+}
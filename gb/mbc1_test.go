@@ -0,0 +1,101 @@
+package gb
+
+import "testing"
+
+func TestMBC1BankSwitching(t *testing.T) {
+	r := fakeBankedROM(0x01, 128, 0)
+
+	checkROMBank(t, r, 0x4000, 0x01)
+	r.W(0x2000, 0x05)
+	checkROMBank(t, r, 0x4000, 0x05)
+	// Bank 0 can't be selected in the high area
+	r.W(0x2000, 0x00)
+	checkROMBank(t, r, 0x4000, 0x01)
+	// Only the lower five bits are used
+	r.W(0x2000, 0xe3)
+	checkROMBank(t, r, 0x4000, 0x03)
+	// Upper bits come from 4000-5FFF
+	r.W(0x4000, 0x02)
+	checkROMBank(t, r, 0x4000, 0x43)
+	checkROMBank(t, r, 0x0000, 0x00)
+}
+
+func TestMBC1BankRemapping(t *testing.T) {
+	r := fakeBankedROM(0x01, 128, 0)
+
+	for _, high := range []uint8{1, 2, 3} {
+		r.W(0x4000, high)
+		r.W(0x2000, 0x00)
+		checkROMBank(t, r, 0x4000, high<<5|1)
+	}
+}
+
+func TestMBC1AdvancedBankingMode(t *testing.T) {
+	r := fakeBankedROM(0x03, 128, 3)
+
+	r.W(0x4000, 0x01)
+	checkROMBank(t, r, 0x0000, 0x00)
+	r.W(0x6000, 0x01)
+	checkROMBank(t, r, 0x0000, 0x20)
+	r.W(0x6000, 0x00)
+	checkROMBank(t, r, 0x0000, 0x00)
+
+	// RAM banks also switch only in advanced mode
+	r.W(0x0000, 0x0a)
+	r.W(0x4000, 0x00)
+	r.W(0xa000, 0x11)
+	r.W(0x4000, 0x02)
+	r.W(0xa000, 0x22)
+	if v := r.R(0xa000); v != 0x22 {
+		t.Errorf("expected RAM bank 0 to read %02Xh, got %02Xh\n", 0x22, v)
+	}
+	r.W(0x6000, 0x01)
+	if v := r.R(0xa000); v != 0x00 {
+		t.Errorf("expected RAM bank 2 to read %02Xh, got %02Xh\n", 0x00, v)
+	}
+	r.W(0x4000, 0x00)
+	if v := r.R(0xa000); v != 0x22 {
+		t.Errorf("expected RAM bank 0 to read %02Xh, got %02Xh\n", 0x22, v)
+	}
+}
+
+func TestMBC1RAMEnable(t *testing.T) {
+	r := fakeBankedROM(0x03, 4, 2)
+
+	r.W(0xa000, 0x33)
+	if v := r.R(0xa000); v != 0xff {
+		t.Errorf("expected disabled RAM to read %02Xh, got %02Xh\n", 0xff, v)
+	}
+	r.W(0x0000, 0x0a)
+	r.W(0xa000, 0x33)
+	if v := r.R(0xa000); v != 0x33 {
+		t.Errorf("expected enabled RAM to read %02Xh, got %02Xh\n", 0x33, v)
+	}
+	r.W(0x0000, 0x00)
+	if v := r.R(0xa000); v != 0xff {
+		t.Errorf("expected disabled RAM to read %02Xh, got %02Xh\n", 0xff, v)
+	}
+}
+
+func TestMBC1Multicart(t *testing.T) {
+	data := make([]byte, 64*int(bankSize))
+	for i := 0; i < 64; i++ {
+		data[i*int(bankSize)] = byte(i)
+	}
+	data[0x0147] = 0x01
+	copy(data[0x10*bankSize+0x0104:], expectedLogo)
+	r, err := LoadROM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.mbc.(*mbc1).multicart {
+		t.Fatalf("expected ROM to be detected as MBC1M\n")
+	}
+
+	r.W(0x2000, 0x12)
+	checkROMBank(t, r, 0x4000, 0x02)
+	r.W(0x4000, 0x01)
+	checkROMBank(t, r, 0x4000, 0x12)
+	r.W(0x6000, 0x01)
+	checkROMBank(t, r, 0x0000, 0x10)
+}
@@ -0,0 +1,93 @@
+package gb
+
+import (
+	"fmt"
+	"io"
+)
+
+const mbc2RAMSize int = 512
+
+/*
+ * The MBC2 has 512 half-bytes of RAM built into the controller itself rather
+ * than on the cartridge, so the header always says there's no RAM. Only the
+ * bottom nine address bits are decoded, so it repeats all the way through
+ * A000-BFFF.
+ */
+type mbc2 struct {
+	rom        *ROM
+	ramEnabled bool
+	romBank    uint8
+	ram        [mbc2RAMSize]uint8
+}
+
+func newMBC2(rom *ROM) MemoryBankController {
+	return &mbc2{rom: rom, romBank: 1}
+}
+
+func (m *mbc2) R(addr uint16) uint8 {
+	switch {
+	case addr < 0x4000:
+		return m.rom.Bank(0)[addr]
+	case addr < 0x8000:
+		return m.rom.Bank(int(m.romBank))[addr-0x4000]
+	}
+	if !m.ramEnabled {
+		return 0xff
+	}
+	// The upper four bits aren't connected and read back as 1s.
+	return m.ram[addr&0x1ff] | 0xf0
+}
+
+func (m *mbc2) W(addr uint16, val uint8) {
+	switch {
+	case addr < 0x4000:
+		// Both registers live in the same range, bit 8 of the address
+		// picks which one we're talking to.
+		if addr&0x100 == 0 {
+			m.ramEnabled = val&0x0f == 0x0a
+		} else {
+			m.romBank = val & 0x0f
+			if m.romBank == 0 {
+				m.romBank = 1
+			}
+		}
+	case addr >= 0xa000 && addr < 0xc000:
+		if !m.ramEnabled {
+			return
+		}
+		m.ram[addr&0x1ff] = val & 0x0f
+		m.rom.MarkRAMDirty()
+	}
+}
+
+func (m *mbc2) SaveState(w io.Writer) error {
+	sw := &stateWriter{w: w}
+	sw.write(m.ramEnabled, m.romBank, m.ram[:])
+	return sw.err
+}
+
+func (m *mbc2) LoadState(r io.Reader) error {
+	sr := &stateReader{r: r}
+	sr.read(&m.ramEnabled, &m.romBank, m.ram[:])
+	return sr.err
+}
+
+// The built-in RAM is saved one half-byte per byte, like everyone else does.
+func (m *mbc2) MarshalBattery() []byte {
+	o := make([]byte, mbc2RAMSize)
+	copy(o, m.ram[:])
+	return o
+}
+
+func (m *mbc2) UnmarshalBattery(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < mbc2RAMSize {
+		return fmt.Errorf("MBC2 save is %d bytes, expected %d", len(b), mbc2RAMSize)
+	}
+	for i := range m.ram {
+		m.ram[i] = b[i] & 0x0f
+	}
+	return nil
+}
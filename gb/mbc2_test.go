@@ -0,0 +1,75 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMBC2BankSwitching(t *testing.T) {
+	r := fakeBankedROM(0x05, 16, 0)
+
+	checkROMBank(t, r, 0x4000, 0x01)
+	r.W(0x2100, 0x05)
+	checkROMBank(t, r, 0x4000, 0x05)
+	r.W(0x0100, 0x07)
+	checkROMBank(t, r, 0x4000, 0x07)
+	r.W(0x2100, 0x00)
+	checkROMBank(t, r, 0x4000, 0x01)
+	// Only the bottom four bits are used
+	r.W(0x2100, 0xf3)
+	checkROMBank(t, r, 0x4000, 0x03)
+	// Without address bit 8 it's a RAM enable, not a bank switch
+	r.W(0x2000, 0x05)
+	checkROMBank(t, r, 0x4000, 0x03)
+}
+
+func TestMBC2RAM(t *testing.T) {
+	r := fakeBankedROM(0x06, 4, 0)
+
+	r.W(0xa000, 0x05)
+	if v := r.R(0xa000); v != 0xff {
+		t.Errorf("expected disabled RAM to read %02Xh, got %02Xh\n", 0xff, v)
+	}
+	// Bit 8 set isn't a RAM enable
+	r.W(0x0100, 0x0a)
+	if v := r.R(0xa000); v != 0xff {
+		t.Errorf("expected disabled RAM to read %02Xh, got %02Xh\n", 0xff, v)
+	}
+	r.W(0x0000, 0x0a)
+	r.W(0xa000, 0x35)
+	if v := r.R(0xa000); v != 0xf5 {
+		t.Errorf("expected RAM to read %02Xh, got %02Xh\n", 0xf5, v)
+	}
+	// It echoes every 512 bytes
+	for addr := uint16(0xa000); addr < 0xc000; addr += 0x200 {
+		if v := r.R(addr + 0x10); v != 0xf0 {
+			t.Errorf("expected (%04Xh) to read %02Xh, got %02Xh\n", addr+0x10, 0xf0, v)
+		}
+		if v := r.R(addr); v != 0xf5 {
+			t.Errorf("expected (%04Xh) to read %02Xh, got %02Xh\n", addr, 0xf5, v)
+		}
+	}
+	r.W(0xbfff, 0x0c)
+	if v := r.R(0xa1ff); v != 0xfc {
+		t.Errorf("expected RAM to read %02Xh, got %02Xh\n", 0xfc, v)
+	}
+}
+
+func TestMBC2BatteryRoundTrip(t *testing.T) {
+	r := fakeBankedROM(0x06, 4, 0)
+	r.W(0x0000, 0x0a)
+	r.W(0xa123, 0x09)
+
+	buf := &bytes.Buffer{}
+	if err := r.SaveBattery(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2 := fakeBankedROM(0x06, 4, 0)
+	if err := r2.LoadBattery(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2.W(0x0000, 0x0a)
+	if v := r2.R(0xa123); v != 0xf9 {
+		t.Errorf("expected RAM to read %02Xh, got %02Xh\n", 0xf9, v)
+	}
+}
@@ -0,0 +1,130 @@
+package gb
+
+import (
+	"io"
+)
+
+type mbc3 struct {
+	rom        *ROM
+	clock      *rtc
+	ramEnabled bool
+	romBank    uint8 // 2000-3FFF
+	ramBank    uint8 // 4000-5FFF, 08h-0Ch select clock registers
+}
+
+func newMBC3(rom *ROM) MemoryBankController {
+	m := &mbc3{rom: rom, romBank: 1}
+	// Only some MBC3 carts have the clock wired up
+	if rom.CartType() == 0x0f || rom.CartType() == 0x10 {
+		m.clock = newRTC()
+	}
+	return m
+}
+
+func (m *mbc3) ramOffset(addr uint16) uint {
+	return (uint(m.ramBank)*ramBankSize + uint(addr-0xa000)) % uint(len(m.rom.RAM()))
+}
+
+func (m *mbc3) clockSelected() bool {
+	return m.ramBank >= rtcSeconds && m.ramBank <= rtcDaysHi
+}
+
+func (m *mbc3) R(addr uint16) uint8 {
+	switch {
+	case addr < 0x4000:
+		return m.rom.Bank(0)[addr]
+	case addr < 0x8000:
+		return m.rom.Bank(int(m.romBank))[addr-0x4000]
+	}
+	if !m.ramEnabled {
+		return 0xff
+	}
+	if m.clockSelected() {
+		if m.clock == nil {
+			return 0xff
+		}
+		return m.clock.R(m.ramBank)
+	}
+	if m.ramBank > 0x03 || len(m.rom.RAM()) == 0 {
+		return 0xff
+	}
+	return m.rom.RAM()[m.ramOffset(addr)]
+}
+
+func (m *mbc3) W(addr uint16, val uint8) {
+	switch {
+	case addr < 0x2000:
+		m.ramEnabled = val&0x0f == 0x0a
+	case addr < 0x4000:
+		m.romBank = val & 0x7f
+		if m.romBank == 0 {
+			m.romBank = 1
+		}
+	case addr < 0x6000:
+		m.ramBank = val
+	case addr < 0x8000:
+		if m.clock != nil {
+			m.clock.latch(val)
+		}
+	case addr >= 0xa000 && addr < 0xc000:
+		if !m.ramEnabled {
+			return
+		}
+		if m.clockSelected() {
+			if m.clock != nil {
+				m.clock.W(m.ramBank, val)
+				m.rom.MarkRAMDirty()
+			}
+			return
+		}
+		if m.ramBank > 0x03 || len(m.rom.RAM()) == 0 {
+			return
+		}
+		m.rom.RAM()[m.ramOffset(addr)] = val
+		m.rom.MarkRAMDirty()
+	}
+}
+
+func (m *mbc3) Step(cycles int) {
+	if m.clock != nil {
+		m.clock.step(cycles)
+	}
+}
+
+func (m *mbc3) SetRTCSource(src RTCSource) {
+	if m.clock != nil {
+		m.clock.setSource(src)
+	}
+}
+
+func (m *mbc3) SaveState(w io.Writer) error {
+	sw := &stateWriter{w: w}
+	sw.write(m.ramEnabled, m.romBank, m.ramBank)
+	if m.clock != nil {
+		m.clock.saveState(sw)
+	}
+	return sw.err
+}
+
+func (m *mbc3) LoadState(r io.Reader) error {
+	sr := &stateReader{r: r}
+	sr.read(&m.ramEnabled, &m.romBank, &m.ramBank)
+	if m.clock != nil {
+		m.clock.loadState(sr)
+	}
+	return sr.err
+}
+
+func (m *mbc3) MarshalBattery() []byte {
+	if m.clock == nil {
+		return nil
+	}
+	return m.clock.marshal()
+}
+
+func (m *mbc3) UnmarshalBattery(b []byte) error {
+	if m.clock == nil || len(b) == 0 {
+		return nil
+	}
+	return m.clock.unmarshal(b)
+}
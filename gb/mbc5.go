@@ -0,0 +1,85 @@
+package gb
+
+import (
+	"io"
+)
+
+type mbc5 struct {
+	rom        *ROM
+	hasRumble  bool
+	rumbling   bool
+	ramEnabled bool
+	romBank    uint16 // 9 bits, low 8 from 2000-2FFF and bit 8 from 3000-3FFF
+	ramBank    uint8  // 4000-5FFF
+}
+
+func newMBC5(rom *ROM) MemoryBankController {
+	t := rom.CartType()
+	return &mbc5{
+		rom:       rom,
+		hasRumble: t >= 0x1c && t <= 0x1e,
+		romBank:   1,
+	}
+}
+
+func (m *mbc5) SaveState(w io.Writer) error {
+	sw := &stateWriter{w: w}
+	sw.write(m.ramEnabled, m.romBank, m.ramBank, m.rumbling)
+	return sw.err
+}
+
+func (m *mbc5) LoadState(r io.Reader) error {
+	sr := &stateReader{r: r}
+	rumbling := m.rumbling
+	sr.read(&m.ramEnabled, &m.romBank, &m.ramBank, &m.rumbling)
+	if sr.err == nil && rumbling != m.rumbling {
+		m.rom.Rumble(m.rumbling)
+	}
+	return sr.err
+}
+
+func (m *mbc5) ramOffset(addr uint16) uint {
+	return (uint(m.ramBank)*ramBankSize + uint(addr-0xa000)) % uint(len(m.rom.RAM()))
+}
+
+func (m *mbc5) R(addr uint16) uint8 {
+	switch {
+	case addr < 0x4000:
+		return m.rom.Bank(0)[addr]
+	case addr < 0x8000:
+		// Unlike the older controllers bank 0 can be mapped here.
+		return m.rom.Bank(int(m.romBank))[addr-0x4000]
+	}
+	if !m.ramEnabled || len(m.rom.RAM()) == 0 {
+		return 0xff
+	}
+	return m.rom.RAM()[m.ramOffset(addr)]
+}
+
+func (m *mbc5) W(addr uint16, val uint8) {
+	switch {
+	case addr < 0x2000:
+		m.ramEnabled = val&0x0f == 0x0a
+	case addr < 0x3000:
+		m.romBank = m.romBank&0x100 | uint16(val)
+	case addr < 0x4000:
+		m.romBank = m.romBank&0xff | uint16(val&0x01)<<8
+	case addr < 0x6000:
+		if m.hasRumble {
+			// Bit 3 drives the motor instead of selecting a bank.
+			rumbling := val&0x08 != 0
+			if rumbling != m.rumbling {
+				m.rumbling = rumbling
+				m.rom.Rumble(rumbling)
+			}
+			val &= 0x07
+		}
+		m.ramBank = val & 0x0f
+	case addr >= 0xa000 && addr < 0xc000:
+		if !m.ramEnabled || len(m.rom.RAM()) == 0 {
+			return
+		}
+		m.rom.RAM()[m.ramOffset(addr)] = val
+		m.rom.MarkRAMDirty()
+	}
+}
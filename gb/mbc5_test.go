@@ -0,0 +1,74 @@
+package gb
+
+import "testing"
+
+type recordingRumbler struct {
+	changes []bool
+}
+
+func (r *recordingRumbler) Rumble(on bool) {
+	r.changes = append(r.changes, on)
+}
+
+func TestMBC5BankSwitching(t *testing.T) {
+	r := fakeBankedROM(0x19, 512, 0)
+
+	checkROMBank(t, r, 0x4000, 0x01)
+	r.W(0x2000, 0x00)
+	checkROMBank(t, r, 0x4000, 0x00)
+	r.W(0x2000, 0x34)
+	checkROMBank(t, r, 0x4000, 0x34)
+	r.W(0x3000, 0x01)
+	if v := r.mbc.(*mbc5).romBank; v != 0x134 {
+		t.Errorf("expected ROM bank %03Xh, got %03Xh\n", 0x134, v)
+	}
+	// Our fake only stores the low byte of the bank number
+	checkROMBank(t, r, 0x4000, 0x34)
+	r.W(0x2000, 0xff)
+	r.W(0x3000, 0x00)
+	checkROMBank(t, r, 0x4000, 0xff)
+}
+
+func TestMBC5RAMBanks(t *testing.T) {
+	r := fakeBankedROM(0x1b, 4, 4)
+
+	r.W(0x0000, 0x0a)
+	for bank := uint8(0); bank < 16; bank++ {
+		r.W(0x4000, bank)
+		r.W(0xa000, bank+0x10)
+	}
+	for bank := uint8(0); bank < 16; bank++ {
+		r.W(0x4000, bank)
+		if v := r.R(0xa000); v != bank+0x10 {
+			t.Errorf("expected RAM bank %d to read %02Xh, got %02Xh\n", bank, bank+0x10, v)
+		}
+	}
+}
+
+func TestMBC5Rumble(t *testing.T) {
+	r := fakeBankedROM(0x1e, 4, 3)
+	rumbler := &recordingRumbler{}
+	r.rumbler = rumbler
+
+	r.W(0x0000, 0x0a)
+	r.W(0x4000, 0x01)
+	r.W(0xa000, 0x55)
+	r.W(0x4000, 0x09)
+	r.W(0x4000, 0x0b)
+	r.W(0x4000, 0x01)
+	// With rumble, bit 3 doesn't select the bank
+	r.W(0x4000, 0x09)
+	if v := r.R(0xa000); v != 0x55 {
+		t.Errorf("expected RAM bank 1 to read %02Xh, got %02Xh\n", 0x55, v)
+	}
+
+	expected := []bool{true, false, true}
+	if len(rumbler.changes) != len(expected) {
+		t.Fatalf("expected rumble changes %v, got %v\n", expected, rumbler.changes)
+	}
+	for i := range expected {
+		if rumbler.changes[i] != expected[i] {
+			t.Errorf("expected rumble changes %v, got %v\n", expected, rumbler.changes)
+		}
+	}
+}
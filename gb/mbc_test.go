@@ -0,0 +1,96 @@
+package gb
+
+import "testing"
+
+type fixedMBC struct {
+	rom    *ROM
+	writes int
+}
+
+func (f *fixedMBC) R(addr uint16) uint8 {
+	return f.rom.Bank(2)[0]
+}
+
+func (f *fixedMBC) W(addr uint16, val uint8) {
+	f.writes++
+}
+
+func TestRegisterMBC(t *testing.T) {
+	var m *fixedMBC
+	RegisterMBC(0xfc, func(rom *ROM) MemoryBankController {
+		m = &fixedMBC{rom: rom}
+		return m
+	})
+	defer delete(mbcFactories, 0xfc)
+
+	r := fakeBankedROM(0xfc, 4, 0)
+	if m == nil {
+		t.Fatalf("expected registered factory to be used\n")
+	}
+	checkROMBank(t, r, 0x4000, 0x02)
+	r.W(0x2000, 0x01)
+	if m.writes != 1 {
+		t.Errorf("expected 1 write to reach the controller, got %d\n", m.writes)
+	}
+}
+
+type batteryMBC struct {
+	fixedMBC
+	battery bool
+}
+
+func (b *batteryMBC) HasBattery() bool {
+	return b.battery
+}
+
+func TestRegisterMBCBattery(t *testing.T) {
+	defer delete(mbcFactories, 0xfc)
+	for _, battery := range []bool{true, false} {
+		RegisterMBC(0xfc, func(rom *ROM) MemoryBankController {
+			return &batteryMBC{fixedMBC{rom: rom}, battery}
+		})
+		r := fakeBankedROM(0xfc, 4, 2)
+		if r.HasBattery() != battery {
+			t.Errorf("expected HasBattery to be %v\n", battery)
+		}
+	}
+}
+
+func TestUnknownCartType(t *testing.T) {
+	data := make([]byte, 2*bankSize)
+	data[0x0147] = 0xfc
+	if _, err := LoadROM(data); err == nil {
+		t.Errorf("expected an error loading cartridge type %02Xh\n", 0xfc)
+	}
+}
+
+func TestNoMBC(t *testing.T) {
+	r := fakeBankedROM(0x00, 2, 0)
+
+	checkROMBank(t, r, 0x0000, 0x00)
+	checkROMBank(t, r, 0x4000, 0x01)
+	r.W(0x2000, 0x05)
+	checkROMBank(t, r, 0x4000, 0x01)
+}
+
+func TestMBC3BankSwitching(t *testing.T) {
+	r := fakeBankedROM(0x13, 128, 3)
+
+	checkROMBank(t, r, 0x4000, 0x01)
+	r.W(0x2000, 0x45)
+	checkROMBank(t, r, 0x4000, 0x45)
+	r.W(0x2000, 0x00)
+	checkROMBank(t, r, 0x4000, 0x01)
+
+	r.W(0x0000, 0x0a)
+	r.W(0x4000, 0x01)
+	r.W(0xa000, 0x11)
+	r.W(0x4000, 0x02)
+	if v := r.R(0xa000); v != 0x00 {
+		t.Errorf("expected RAM bank 2 to read %02Xh, got %02Xh\n", 0x00, v)
+	}
+	r.W(0x4000, 0x01)
+	if v := r.R(0xa000); v != 0x11 {
+		t.Errorf("expected RAM bank 1 to read %02Xh, got %02Xh\n", 0x11, v)
+	}
+}
@@ -0,0 +1,438 @@
+package gb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mooneyeDir = "../third_party/mooneye"
+
+// LD B,B, which mooneye ROMs run when they're done.
+const mooneyeDoneOpcode uint8 = 0x40
+
+// Registers B, C, D, E, H and L hold the start of the Fibonacci sequence if
+// the test passed.
+var mooneyePassRegs = [6]uint8{3, 5, 8, 13, 21, 34}
+
+/*
+ * The DMG acceptance ROMs from mooneye-test-suite, relative to mooneyeDir.
+ * Each should end with the Fibonacci registers unless it has a known failure
+ * saying why it doesn't. The built suite comes from
+ * https://gekkio.fi/files/mooneye-gb/ and unpacks into mooneyeDir. It isn't
+ * checked in yet, so none of these have been run and there are no known
+ * failures; whatever the first run turns up goes here.
+ */
+var mooneyeROMs = []struct {
+	rom   string
+	known string
+}{
+	{"acceptance/add_sp_e_timing.gb", ""},
+	{"acceptance/boot_div-dmgABCmgb.gb", ""},
+	{"acceptance/boot_hwio-dmgABCmgb.gb", ""},
+	{"acceptance/boot_regs-dmgABC.gb", ""},
+	{"acceptance/call_cc_timing.gb", ""},
+	{"acceptance/call_cc_timing2.gb", ""},
+	{"acceptance/call_timing.gb", ""},
+	{"acceptance/call_timing2.gb", ""},
+	{"acceptance/di_timing-GS.gb", ""},
+	{"acceptance/div_timing.gb", ""},
+	{"acceptance/ei_sequence.gb", ""},
+	{"acceptance/ei_timing.gb", ""},
+	{"acceptance/halt_ime0_ei.gb", ""},
+	{"acceptance/halt_ime0_nointr_timing.gb", ""},
+	{"acceptance/halt_ime1_timing.gb", ""},
+	{"acceptance/halt_ime1_timing2-GS.gb", ""},
+	{"acceptance/if_ie_registers.gb", ""},
+	{"acceptance/intr_timing.gb", ""},
+	{"acceptance/jp_cc_timing.gb", ""},
+	{"acceptance/jp_timing.gb", ""},
+	{"acceptance/ld_hl_sp_e_timing.gb", ""},
+	{"acceptance/oam_dma_restart.gb", ""},
+	{"acceptance/oam_dma_start.gb", ""},
+	{"acceptance/oam_dma_timing.gb", ""},
+	{"acceptance/pop_timing.gb", ""},
+	{"acceptance/push_timing.gb", ""},
+	{"acceptance/rapid_di_ei.gb", ""},
+	{"acceptance/ret_cc_timing.gb", ""},
+	{"acceptance/ret_timing.gb", ""},
+	{"acceptance/reti_intr_timing.gb", ""},
+	{"acceptance/reti_timing.gb", ""},
+	{"acceptance/rst_timing.gb", ""},
+	{"acceptance/bits/mem_oam.gb", ""},
+	{"acceptance/bits/reg_f.gb", ""},
+	{"acceptance/bits/unused_hwio-GS.gb", ""},
+	{"acceptance/instr/daa.gb", ""},
+	{"acceptance/interrupts/ie_push.gb", ""},
+	{"acceptance/oam_dma/basic.gb", ""},
+	{"acceptance/oam_dma/reg_read.gb", ""},
+	{"acceptance/oam_dma/sources-GS.gb", ""},
+	{"acceptance/ppu/hblank_ly_scx_timing-GS.gb", ""},
+	{"acceptance/ppu/intr_1_2_timing-GS.gb", ""},
+	{"acceptance/ppu/intr_2_0_timing.gb", ""},
+	{"acceptance/ppu/intr_2_mode0_timing.gb", ""},
+	{"acceptance/ppu/intr_2_mode0_timing_sprites.gb", ""},
+	{"acceptance/ppu/intr_2_mode3_timing.gb", ""},
+	{"acceptance/ppu/intr_2_oam_ok_timing.gb", ""},
+	{"acceptance/ppu/lcdon_timing-GS.gb", ""},
+	{"acceptance/ppu/lcdon_write_timing-GS.gb", ""},
+	{"acceptance/ppu/stat_irq_blocking.gb", ""},
+	{"acceptance/ppu/stat_lyc_onoff.gb", ""},
+	{"acceptance/ppu/vblank_stat_intr-GS.gb", ""},
+	{"acceptance/serial/boot_sclk_align-dmgABCmgb.gb", ""},
+	{"acceptance/timer/div_write.gb", ""},
+	{"acceptance/timer/rapid_toggle.gb", ""},
+	{"acceptance/timer/tim00.gb", ""},
+	{"acceptance/timer/tim00_div_trigger.gb", ""},
+	{"acceptance/timer/tim01.gb", ""},
+	{"acceptance/timer/tim01_div_trigger.gb", ""},
+	{"acceptance/timer/tim10.gb", ""},
+	{"acceptance/timer/tim10_div_trigger.gb", ""},
+	{"acceptance/timer/tim11.gb", ""},
+	{"acceptance/timer/tim11_div_trigger.gb", ""},
+	{"acceptance/timer/tima_reload.gb", ""},
+	{"acceptance/timer/tima_write_reloading.gb", ""},
+	{"acceptance/timer/tma_write_reloading.gb", ""},
+}
+
+// Whether a ROM is meant to pass on a DMG. The models it's for come after the
+// last dash in its name, and ROMs without one are for every model.
+func mooneyeForDMG(path string) bool {
+	name := strings.TrimSuffix(filepath.Base(path), ".gb")
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return true
+	}
+	models := name[i+1:]
+	return strings.Contains(models, "dmgABC") || strings.Contains(models, "G")
+}
+
+// The DMG acceptance ROMs under mooneyeDir, relative to it.
+func mooneyeAcceptanceROMs() ([]string, error) {
+	var paths []string
+	err := filepath.Walk(filepath.Join(mooneyeDir, "acceptance"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".gb" || !mooneyeForDMG(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(mooneyeDir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	return paths, err
+}
+
+// How long to give each ROM to hit LD B,B, in emulated seconds
+const mooneyeTimeout = 20
+
+// Run until the ROM signals it's done with LD B,B, then check the registers.
+func runMooneye(r *ROM, timeout int) (passed bool, output string) {
+	sys := NewSys(r)
+	done := false
+	sys.SetOpcodeHook(func(sys *Sys, addr uint16, opcode uint8) {
+		if opcode == mooneyeDoneOpcode {
+			done = true
+		}
+	})
+	end := timeout * int(clkFreq)
+	sys.RunUntil(func(sys *Sys) bool {
+		return done || sys.Wall >= end
+	})
+	c := sys.cpu
+	regs := [6]uint8{c.b, c.c, c.d, c.e, c.h, c.l}
+	output = fmt.Sprintf("B=%02Xh C=%02Xh D=%02Xh E=%02Xh H=%02Xh L=%02Xh", c.b, c.c, c.d, c.e, c.h, c.l)
+	if !done {
+		return false, "timed out with " + output
+	}
+	return regs == mooneyePassRegs, output
+}
+
+func TestMooneye(t *testing.T) {
+	// Every DMG ROM that's checked in should be in the table
+	paths, err := mooneyeAcceptanceROMs()
+	if err != nil {
+		t.Fatalf("%v, check the suite in from https://gekkio.fi/files/mooneye-gb/\n", err)
+	}
+	listed := map[string]bool{}
+	for _, rom := range mooneyeROMs {
+		listed[rom.rom] = true
+	}
+	for _, path := range paths {
+		if !listed[path] {
+			t.Errorf("ROM %s isn't in mooneyeROMs\n", path)
+		}
+	}
+
+	for _, rom := range mooneyeROMs {
+		rom := rom
+		t.Run(rom.rom, func(t *testing.T) {
+			r, err := LoadROMFromFile(filepath.Join(mooneyeDir, rom.rom))
+			if err != nil {
+				t.Fatal(err)
+			}
+			passed, output := runMooneye(r, mooneyeTimeout)
+			switch {
+			case passed && rom.known != "":
+				t.Logf("ROM %s passes now, remove its known failure\n", rom.rom)
+			case !passed && rom.known != "":
+				t.Skipf("ROM %s is a known failure (%s): %s\n", rom.rom, rom.known, output)
+			case !passed:
+				t.Errorf("ROM %s failed: %s\n", rom.rom, output)
+			}
+		})
+	}
+}
+
+func TestMooneyeForDMG(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"acceptance/add_sp_e_timing.gb":                  true,
+		"acceptance/boot_regs-dmgABC.gb":                 true,
+		"acceptance/boot_div-dmgABCmgb.gb":               true,
+		"acceptance/di_timing-GS.gb":                     true,
+		"acceptance/boot_regs-dmg0.gb":                   false,
+		"acceptance/boot_regs-sgb.gb":                    false,
+		"acceptance/boot_hwio-S.gb":                      false,
+		"acceptance/serial/boot_sclk_align-dmgABCmgb.gb": true,
+	} {
+		if got := mooneyeForDMG(path); got != expected {
+			t.Errorf("expected %s to be for DMG: %v, got %v\n", path, expected, got)
+		}
+	}
+}
+
+// Appended to the in-tree ROMs: pass if A is 0, fail otherwise.
+var mooneyeFinish = []byte{
+	0xb7,       // OR A
+	0x20, 0x0f, // JR NZ,fail
+	0x06, 3, // LD B,3
+	0x0e, 5, // LD C,5
+	0x16, 8, // LD D,8
+	0x1e, 13, // LD E,13
+	0x26, 21, // LD H,21
+	0x2e, 34, // LD L,34
+	0x40,       // LD B,B
+	0x18, 0xfe, // JR -2
+	// fail:
+	0x06, 0x42, // LD B,42h
+	0x40,       // LD B,B
+	0x18, 0xfe, // JR -2
+}
+
+// A ROM that jumps over the header to code followed by mooneyeFinish, with
+// each of extra at the address it's keyed by.
+func mooneyeTestROM(code []byte, extra map[uint16][]byte) *ROM {
+	data := make([]byte, 0x8000)
+	copy(data[0x100:], []byte{
+		0x00,             // NOP
+		0xc3, 0x50, 0x01, // JP 0150h
+	})
+	copy(data[0x150:], append(append([]byte{}, code...), mooneyeFinish...))
+	for addr, b := range extra {
+		copy(data[addr:], b)
+	}
+	r, err := LoadROM(data)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+/*
+ * Small ROMs that follow the mooneye conventions, for behaviour we can't
+ * check with the real suite because it isn't checked in. Unlike the suite
+ * these must pass. Each leaves 0 in A for mooneyeFinish if it passed.
+ */
+var mooneyeTestROMs = []struct {
+	name  string
+	code  []byte
+	extra map[uint16][]byte
+}{
+	{
+		// With the line already high from mode 0, LY=LYC coming true
+		// doesn't make another rising edge
+		"stat_hblank_blocks_lyc",
+		[]byte{
+			0xf3,       // DI
+			0x3e, 0xff, // LD A,FFh
+			0xe0, 0x45, // LDH (LYC),A
+			0x3e, 0x48, // LD A,48h
+			0xe0, 0x41, // LDH (STAT),A
+			// mode3:
+			0xf0, 0x41, // LDH A,(STAT)
+			0xe6, 0x03, // AND 3
+			0xfe, 0x03, // CP 3
+			0x20, 0xf8, // JR NZ,mode3
+			0xaf,       // XOR A
+			0xe0, 0x0f, // LDH (IF),A
+			// mode0:
+			0xf0, 0x41, // LDH A,(STAT)
+			0xe6, 0x03, // AND 3
+			0x20, 0xfa, // JR NZ,mode0
+			// Mode 0 on its own raises it
+			0xf0, 0x0f, // LDH A,(IF)
+			0xe6, 0x02, // AND 2
+			0xee, 0x02, // XOR 2
+			0x5f,       // LD E,A
+			0xaf,       // XOR A
+			0xe0, 0x0f, // LDH (IF),A
+			0xf0, 0x44, // LDH A,(LY)
+			0xe0, 0x45, // LDH (LYC),A
+			// But LY=LYC on top of it doesn't
+			0xf0, 0x0f, // LDH A,(IF)
+			0xe6, 0x02, // AND 2
+			0xb3, // OR E
+		},
+		nil,
+	},
+	{
+		// The mode 1 STAT interrupt comes along with the VBlank one
+		"stat_mode1_with_vblank",
+		[]byte{
+			0xf3,       // DI
+			0x3e, 0x10, // LD A,10h
+			0xe0, 0x41, // LDH (STAT),A
+			// ly143:
+			0xf0, 0x44, // LDH A,(LY)
+			0xfe, 0x8f, // CP 143
+			0x20, 0xfa, // JR NZ,ly143
+			0xaf,       // XOR A
+			0xe0, 0x0f, // LDH (IF),A
+			// ly144:
+			0xf0, 0x44, // LDH A,(LY)
+			0xfe, 0x90, // CP 144
+			0x20, 0xfa, // JR NZ,ly144
+			0xf0, 0x0f, // LDH A,(IF)
+			0xe6, 0x03, // AND 3
+			0xee, 0x03, // XOR 3
+		},
+		nil,
+	},
+	{
+		// A DMA from WRAM copies all of it, and OAM reads FFh for the
+		// 160 cycles it takes, after a cycle to get going
+		"oam_dma_hram",
+		[]byte{
+			0xf3, // DI
+			// vblank:
+			0xf0, 0x44, // LDH A,(LY)
+			0xfe, 0x90, // CP 144
+			0x20, 0xfa, // JR NZ,vblank
+			0xaf,       // XOR A
+			0xe0, 0x40, // LDH (LCDC),A
+			// Fill C000-C09F with each address's low byte XOR 5Ah
+			0x21, 0x00, 0xc0, // LD HL,C000h
+			0x0e, 0xa0, // LD C,A0h
+			// fill:
+			0x7d,       // LD A,L
+			0xee, 0x5a, // XOR 5Ah
+			0x22,       // LD (HL+),A
+			0x0d,       // DEC C
+			0x20, 0xf9, // JR NZ,fill
+			// Copy the routine at 0200h to HRAM and run it
+			0x21, 0x80, 0xff, // LD HL,FF80h
+			0x11, 0x00, 0x02, // LD DE,0200h
+			0x0e, 0x19, // LD C,19h
+			// copy:
+			0x1a,       // LD A,(DE)
+			0x13,       // INC DE
+			0x22,       // LD (HL+),A
+			0x0d,       // DEC C
+			0x20, 0xfa, // JR NZ,copy
+			0x3e, 0xc0, // LD A,C0h
+			0xcd, 0x80, 0xff, // CALL FF80h
+			// B and C were read during the DMA, D after it
+			0x78,       // LD A,B
+			0xee, 0xff, // XOR FFh
+			0x5f,       // LD E,A
+			0x79,       // LD A,C
+			0xee, 0xff, // XOR FFh
+			0xb3,       // OR E
+			0x5f,       // LD E,A
+			0x7a,       // LD A,D
+			0xee, 0x5a, // XOR 5Ah
+			0xb3, // OR E
+			0x5f, // LD E,A
+			// Then all of OAM should match
+			0x21, 0x00, 0xfe, // LD HL,FE00h
+			0x0e, 0xa0, // LD C,A0h
+			// check:
+			0x7d,       // LD A,L
+			0xee, 0x5a, // XOR 5Ah
+			0xae,       // XOR (HL)
+			0xb3,       // OR E
+			0x5f,       // LD E,A
+			0x2c,       // INC L
+			0x0d,       // DEC C
+			0x20, 0xf6, // JR NZ,check
+			0x7b, // LD A,E
+		},
+		map[uint16][]byte{
+			0x0200: {
+				0xe0, 0x46, // LDH (DMA),A
+				// 4 cycles after the write
+				0xfa, 0x00, 0xfe, // LD A,(FE00h)
+				0x47,       // LD B,A
+				0x3e, 0x23, // LD A,35
+				// wait1:
+				0x3d,       // DEC A
+				0x20, 0xfd, // JR NZ,wait1
+				// 150 cycles after
+				0xfa, 0x00, 0xfe, // LD A,(FE00h)
+				0x4f,       // LD C,A
+				0x3e, 0x05, // LD A,5
+				// wait2:
+				0x3d,       // DEC A
+				0x20, 0xfd, // JR NZ,wait2
+				// 176 cycles after
+				0xfa, 0x00, 0xfe, // LD A,(FE00h)
+				0x57, // LD D,A
+				0xc9, // RET
+			},
+		},
+	},
+}
+
+func TestMooneyeTestROMs(t *testing.T) {
+	for _, rom := range mooneyeTestROMs {
+		if passed, output := runMooneye(mooneyeTestROM(rom.code, rom.extra), 1); !passed {
+			t.Errorf("ROM %s failed: %s\n", rom.name, output)
+		}
+	}
+}
+
+func TestMooneyeHarness(t *testing.T) {
+	passing := FakeROM([]byte{
+		0x06, 3, // LD B,3
+		0x0e, 5, // LD C,5
+		0x16, 8, // LD D,8
+		0x1e, 13, // LD E,13
+		0x26, 21, // LD H,21
+		0x2e, 34, // LD L,34
+		0x40,       // LD B,B
+		0x18, 0xfe, // JR -2
+	})
+	if passed, output := runMooneye(passing, 1); !passed {
+		t.Errorf("expected the Fibonacci registers to pass, got %s\n", output)
+	}
+
+	failing := FakeROM([]byte{
+		0x06, 0x42, // LD B,42h
+		0x40,       // LD B,B
+		0x18, 0xfe, // JR -2
+	})
+	if passed, _ := runMooneye(failing, 1); passed {
+		t.Errorf("expected failure\n")
+	}
+
+	// Never finishing times out
+	if passed, _ := runMooneye(FakeROM([]byte{0x18, 0xfe}), 1); passed {
+		t.Errorf("expected a timeout to fail\n")
+	}
+}
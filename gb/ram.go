@@ -32,12 +32,13 @@ func NewRAM(startAddr uint16, endAddr uint16) *RAM {
 }
 
 func (r *RAM) R(addr uint16) uint8 {
-	addr %= uint16(len(r.data))
+	// Wrapping lets SystemRAM cover the echo area too
+	addr = (addr - r.startAddr) % uint16(len(r.data))
 	return r.data[addr]
 }
 
 func (r *RAM) W(addr uint16, val uint8) {
-	addr %= uint16(len(r.data))
+	addr = (addr - r.startAddr) % uint16(len(r.data))
 	r.data[addr] = val
 }
 
@@ -38,6 +38,19 @@ func TestRAMStorageAndRetrieval(t *testing.T) {
 	}
 }
 
+func TestRAMUnalignedStart(t *testing.T) {
+	// Like OAM, which DMA and sprite fetches index from its start
+	r := NewRAM(0xfe00, 0xfe9f)
+	r.W(0xfe00, 0x12)
+	r.W(0xfe9f, 0x34)
+	if r.data[0] != 0x12 || r.data[0x9f] != 0x34 {
+		t.Errorf("expected writes to land at their offset from the start\n")
+	}
+	if got := r.R(0xfe00); got != 0x12 {
+		t.Errorf("expected r.R(FE00h) to be 12h, got %02Xh\n", got)
+	}
+}
+
 func TestMemRegisterAsserts(t *testing.T) {
 	r := NewMemRegister(0xff10)
 	for addr := uint(0); addr < 0xff10; addr++ {
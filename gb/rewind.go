@@ -0,0 +1,119 @@
+package gb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+/*
+ * A Rewinder keeps a history of save states so we can step backwards in time
+ * a frame at a time. Only the newest state is kept whole. For every older
+ * frame we keep the XOR of it against the frame after it, which is almost all
+ * zeros and compresses really well. Walking backwards is then just XORing the
+ * deltas back in one at a time.
+ *
+ * Once the deltas take up more than the memory budget the oldest ones are
+ * thrown away.
+ */
+type Rewinder struct {
+	budget  int
+	used    int
+	current []byte
+	// Oldest first
+	deltas []rewindDelta
+}
+
+type rewindDelta struct {
+	// The length of the older state, in case the states differ in size
+	prevLen    int
+	compressed []byte
+}
+
+// Make a Rewinder that uses about budget bytes for its history.
+func NewRewinder(budget int) *Rewinder {
+	return &Rewinder{budget: budget}
+}
+
+// The number of frames we can currently step back.
+func (r *Rewinder) Len() int {
+	return len(r.deltas)
+}
+
+// Record the current state of the system as the newest frame.
+func (r *Rewinder) Push(sys *Sys) error {
+	buf := &bytes.Buffer{}
+	if err := sys.SaveState(buf); err != nil {
+		return err
+	}
+	state := buf.Bytes()
+	if r.current != nil {
+		compressed, err := compress(xorBytes(r.current, state))
+		if err != nil {
+			return err
+		}
+		r.deltas = append(r.deltas, rewindDelta{len(r.current), compressed})
+		r.used += len(compressed)
+	}
+	r.current = state
+	for r.used > r.budget && len(r.deltas) > 0 {
+		r.used -= len(r.deltas[0].compressed)
+		r.deltas = r.deltas[1:]
+	}
+	return nil
+}
+
+/*
+ * Step the system back to the previous frame we know about. This returns
+ * false if we've run out of history.
+ */
+func (r *Rewinder) Rewind(sys *Sys) (bool, error) {
+	if len(r.deltas) == 0 {
+		return false, nil
+	}
+	d := r.deltas[len(r.deltas)-1]
+	delta, err := decompress(d.compressed)
+	if err != nil {
+		return false, err
+	}
+	prev := xorBytes(r.current, delta)[:d.prevLen]
+	if err := sys.LoadState(bytes.NewReader(prev)); err != nil {
+		return false, err
+	}
+	r.deltas = r.deltas[:len(r.deltas)-1]
+	r.used -= len(d.compressed)
+	r.current = prev
+	return true, nil
+}
+
+// XOR two slices, treating the shorter one as if it were padded with zeros.
+func xorBytes(a []byte, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	o := make([]byte, len(a))
+	copy(o, a)
+	for i, v := range b {
+		o[i] ^= v
+	}
+	return o
+}
+
+func compress(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(b []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+}
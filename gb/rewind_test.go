@@ -0,0 +1,77 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameHook(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	frames := 0
+	s.AddFrameHook(func(sys *Sys) {
+		frames++
+	})
+	for i := 0; i < totalCycles*3/4; i++ {
+		s.Step()
+	}
+	if frames != 3 {
+		t.Errorf("expected 3 frames, got %d\n", frames)
+	}
+}
+
+func TestRewind(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	s.SetSerialSwapper(&BufferSerialSwapper{})
+	rw := NewRewinder(1 << 20)
+	states := [][]byte{}
+	s.AddFrameHook(func(sys *Sys) {
+		if err := rw.Push(sys); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, saveStateBytes(t, sys))
+	})
+	for len(states) < 20 {
+		s.Step()
+	}
+	if rw.Len() != 19 {
+		t.Errorf("expected 19 frames of history, got %d\n", rw.Len())
+	}
+
+	for i := len(states) - 2; i >= 0; i-- {
+		ok, err := rw.Rewind(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected to be able to rewind to frame %d\n", i)
+		}
+		if got := saveStateBytes(t, s); !bytes.Equal(got, states[i]) {
+			t.Errorf("expected state after rewind to match frame %d\n", i)
+		}
+	}
+	if ok, _ := rw.Rewind(s); ok {
+		t.Errorf("expected rewind to fail once history is exhausted\n")
+	}
+}
+
+func TestRewindBudget(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	s.SetSerialSwapper(&BufferSerialSwapper{})
+	rw := NewRewinder(4096)
+	pushes := 0
+	s.AddFrameHook(func(sys *Sys) {
+		if err := rw.Push(sys); err != nil {
+			t.Fatal(err)
+		}
+		pushes++
+	})
+	for pushes < 100 {
+		s.Step()
+	}
+	if rw.used > rw.budget {
+		t.Errorf("expected history to fit in %d bytes, used %d\n", rw.budget, rw.used)
+	}
+	if rw.Len() == 0 || rw.Len() >= 99 {
+		t.Errorf("expected some but not all history to be kept, got %d frames\n", rw.Len())
+	}
+}
@@ -3,8 +3,10 @@ package gb
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 )
 
 var expectedLogo []byte = []byte{
@@ -28,19 +30,30 @@ var ramSizeMap map[byte]uint = map[byte]uint{
 	5: 0x10000,
 }
 
+/*
+ * A ROM is the cartridge image along with any RAM on the cartridge. All bus
+ * accesses are handed to the cartridge's MemoryBankController, which decides
+ * which bank of ROM or RAM they hit.
+ */
 type ROM struct {
-	data           []byte
-	title          string
-	sgbSupport     bool
-	cartType       byte
-	romSize        byte
-	ramSize        byte
-	banks          [][]byte
-	currentBank    uint
-	ram            []byte
-	ramBanks       [][]byte
-	currentRAMBank uint
-	ramEnabled     bool
+	data       []byte
+	title      string
+	sgbSupport bool
+	cartType   byte
+	romSize    byte
+	ramSize    byte
+	banks      [][]byte
+	ram        []byte
+	mbc        MemoryBankController
+	rumbler    Rumbler
+
+	savePath string
+	ramDirty bool
+}
+
+// Gets told whenever a cartridge's rumble motor turns on or off.
+type Rumbler interface {
+	Rumble(on bool)
 }
 
 func LoadROMFromFile(fn string) (*ROM, error) {
@@ -70,26 +83,65 @@ func LoadROM(data []byte) (*ROM, error) {
 		addr := uint(i * bankSize)
 		r.banks[i] = r.data[addr : addr+bankSize]
 	}
-	r.currentBank = 1
-
-	// Record RAM banks
-	//r.ram = make([]byte, ramSizeMap[r.ramSize])
-	r.ram = make([]byte, ramSizeMap[5])
-	nRamBanks := uint(len(r.ram)) / ramBankSize
-	r.ramBanks = make([][]byte, nRamBanks)
-	// Special case here since $01 is smaller than a full bank
-	if nRamBanks == 1 {
-		r.ramBanks[0] = r.ram
-	} else {
-		for i := uint(0); i < nRamBanks; i++ {
-			addr := uint(i * ramBankSize)
-			r.ramBanks[i] = r.ram[addr : addr+ramBankSize]
-		}
+
+	r.ram = make([]byte, ramSizeMap[r.ramSize])
+
+	factory, ok := mbcFactories[r.cartType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cartridge type %02Xh", r.cartType)
 	}
+	r.mbc = factory(&r)
 
 	return &r, nil
 }
 
+// The cartridge type byte from the header (0147h).
+func (r *ROM) CartType() byte {
+	return r.cartType
+}
+
+// The number of 16k banks in the ROM image.
+func (r *ROM) NumBanks() int {
+	return len(r.banks)
+}
+
+// Bank n of the ROM image. Banks past the end of the image wrap around, as
+// they would on a real cartridge with unconnected address lines.
+func (r *ROM) Bank(n int) []byte {
+	return r.banks[n%len(r.banks)]
+}
+
+// The cartridge RAM. This may be empty if the cartridge has none. Controllers
+// should call MarkRAMDirty after writing to it.
+func (r *ROM) RAM() []byte {
+	return r.ram
+}
+
+// Note that battery-backed state has changed and needs to be saved.
+func (r *ROM) MarkRAMDirty() {
+	r.ramDirty = true
+}
+
+// Whether the cartridge has a battery to keep its RAM (or clock) alive.
+func (r *ROM) HasBattery() bool {
+	if b, ok := r.mbc.(BatteryMBC); ok {
+		return b.HasBattery()
+	}
+	switch r.cartType {
+	case 0x03, 0x06, 0x09, 0x0d, 0x0f, 0x10, 0x13, 0x1b, 0x1e, 0x22, 0xff:
+		return true
+	}
+	return false
+}
+
+// Turn the rumble motor on or off. Controllers with a motor should call this
+// whenever it changes.
+func (r *ROM) Rumble(on bool) {
+	if r.rumbler != nil {
+		r.rumbler.Rumble(on)
+	}
+}
+
 func (r *ROM) HeaderChecksum() byte {
 	x := 0
 	for _, b := range r.data[0x0134:0x014d] {
@@ -153,67 +205,154 @@ func (r *ROM) Info() string {
 }
 
 func (r *ROM) R(addr uint16) uint8 {
-	if addr < 0x4000 {
-		return r.data[addr]
-	} else if addr < 0x8000 {
-		return r.banks[r.currentBank][addr-0x4000]
-	}
-	//if !r.ramEnabled {
-	//	log.Printf("!!! Attempt to read from cart RAM when disabled\n")
-	//	return 0xff
-	//}
-	log.Printf("Read of %04Xh\n", addr)
-	return r.ramBanks[r.currentRAMBank][addr-0xa000]
+	return r.mbc.R(addr)
 }
 
 func (r *ROM) W(addr uint16, val uint8) {
-	// Only works with MBC3 now
-	if addr >= 0x0000 && addr < 0x2000 {
-		if r.ramEnabled {
-			log.Printf("Cartridge RAM was enabled\n")
-		} else {
-			log.Printf("Cartridge RAM was disabled\n")
-		}
-		r.ramEnabled = val&0x0a == 0x0a
-		if r.ramEnabled {
-			log.Printf("Cartridge RAM now enabled\n")
-		} else {
-			log.Printf("Cartridge RAM now disabled\n")
-		}
-		return
+	r.mbc.W(addr, val)
+}
+
+// How often (in Hz) battery saves are written if the RAM has changed.
+const saveFlushFreq uint = 1
+
+func (r *ROM) Step(sys *Sys) {
+	if c, ok := r.mbc.(ClockedMBC); ok {
+		c.Step(4)
 	}
-	if addr >= 0x2000 && addr < 0x4000 {
-		newBank := uint(val)
-		if newBank == 0 {
-			newBank = 1
+	if r.ramDirty && sys.FreqStep(saveFlushFreq) {
+		if err := r.FlushSave(); err != nil {
+			log.Printf("Failed to write save: %v\n", err)
 		}
-		if newBank/uint(len(r.banks)) != 0 {
-			log.Printf("!!! Attempt to switch to bank beyond number in cart %04Xh\n", val)
-		}
-		r.currentBank = newBank % uint(len(r.banks))
-		return
 	}
-	if addr >= 0x4000 && addr < 0x6000 {
-		if len(r.ramBanks) == 0 {
-			log.Printf("!!! Attempt to write to RAM bank on ROM with no RAM")
-			return
-		}
-		newBank := uint(val)
-		if newBank > uint(len(r.ramBanks))/ramBankSize {
-			log.Printf("!!! Attempt to switch to ROM bank beyond number in cart %04Xh\n", val)
+}
+
+// Choose where the cartridge's real-time clock, if it has one, gets its time.
+func (r *ROM) SetRTCSource(src RTCSource) {
+	if c, ok := r.mbc.(interface {
+		SetRTCSource(RTCSource)
+	}); ok {
+		c.SetRTCSource(src)
+	}
+}
+
+// Write out everything the cartridge battery keeps alive: the RAM followed by
+// any extra controller state.
+func (r *ROM) SaveBattery(w io.Writer) error {
+	if _, err := w.Write(r.ram); err != nil {
+		return err
+	}
+	if b, ok := r.mbc.(BatteryBackedMBC); ok {
+		if _, err := w.Write(b.MarshalBattery()); err != nil {
+			return err
 		}
-		r.currentRAMBank = newBank % uint(len(r.ramBanks))
-		return
-	}
-	if addr >= 0xa000 && addr < 0xc000 {
-		//if !r.ramEnabled {
-		//	log.Printf("!!! Attempt to write to cart RAM when disabled\n")
-		//	return
-		//}
-		r.ramBanks[r.currentRAMBank][addr-0xa000] = val
-		return
-	}
-	log.Printf("Attempt to write to ROM at %04Xh with val %02Xh ignored", addr, val)
+	}
+	return nil
+}
+
+// Restore state written by SaveBattery. Saves that are shorter than the RAM
+// only restore what they have.
+func (r *ROM) LoadBattery(rd io.Reader) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	n := copy(r.ram, data)
+	if b, ok := r.mbc.(BatteryBackedMBC); ok {
+		return b.UnmarshalBattery(data[n:])
+	}
+	return nil
+}
+
+/*
+ * Keep battery-backed state in the file at path, loading it now if it already
+ * exists. This does nothing for carts without a battery.
+ */
+func (r *ROM) OpenSave(path string) error {
+	if !r.HasBattery() {
+		return nil
+	}
+	r.savePath = path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.LoadBattery(f); err != nil {
+		return fmt.Errorf("loading %s: %v", path, err)
+	}
+	r.ramDirty = false
+	return nil
+}
+
+// Write the save file if anything has changed since it was last written.
+func (r *ROM) FlushSave() error {
+	if !r.ramDirty {
+		return nil
+	}
+	return r.WriteSave()
+}
+
+/*
+ * Write the save file unconditionally. We write to a temporary file and
+ * rename it over the old one so a crash halfway through doesn't leave us with
+ * a truncated save.
+ */
+func (r *ROM) WriteSave() error {
+	if r.savePath == "" {
+		return nil
+	}
+	tmpPath := r.savePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := r.SaveBattery(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, r.savePath); err != nil {
+		return err
+	}
+	r.ramDirty = false
+	return nil
+}
+
+/*
+ * The header title and checksums go in save states so we can refuse to load a
+ * state from a different game.
+ */
+func (r *ROM) identity() []byte {
+	return r.data[0x0134:0x0150]
+}
+
+func (r *ROM) saveState(w *stateWriter) {
+	w.blob(r.identity())
+	w.blob(r.ram)
+	mbcState := &bytes.Buffer{}
+	if s, ok := r.mbc.(StatefulMBC); ok && w.err == nil {
+		w.err = s.SaveState(mbcState)
+	}
+	w.blob(mbcState.Bytes())
+}
+
+func (r *ROM) loadState(rd *stateReader) {
+	id := rd.blob()
+	if rd.err == nil && !bytes.Equal(id, r.identity()) {
+		rd.err = fmt.Errorf("save state is for a different cartridge")
+	}
+	rd.blobInto(r.ram, "cartridge RAM")
+	mbcState := rd.blob()
+	if s, ok := r.mbc.(StatefulMBC); ok && rd.err == nil {
+		rd.err = s.LoadState(bytes.NewReader(mbcState))
+	}
+	if rd.err == nil {
+		r.MarkRAMDirty()
+	}
 }
 
 func (r *ROM) Asserts(addr uint16) bool {
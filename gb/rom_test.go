@@ -0,0 +1,105 @@
+package gb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Make a fake ROM with nBanks banks where the first byte of every bank holds
+ * its bank number, so we can easily tell which bank is mapped where.
+ */
+func fakeBankedROM(cartType byte, nBanks int, ramSize byte) *ROM {
+	data := make([]byte, nBanks*int(bankSize))
+	for i := 0; i < nBanks; i++ {
+		data[i*int(bankSize)] = byte(i)
+	}
+	data[0x0147] = cartType
+	data[0x0149] = ramSize
+
+	r, err := LoadROM(data)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func checkROMBank(t *testing.T, r *ROM, addr uint16, expected uint8) {
+	if v := r.R(addr); v != expected {
+		t.Errorf("expected bank %02Xh at %04Xh, got %02Xh\n", expected, addr, v)
+	}
+}
+
+func TestRAMSizeFromHeader(t *testing.T) {
+	for ramSize, expected := range ramSizeMap {
+		r := fakeBankedROM(0x03, 4, ramSize)
+		if l := uint(len(r.RAM())); l != expected {
+			t.Errorf("expected RAM size %02Xh to give %d bytes, got %d\n", ramSize, expected, l)
+		}
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blitzle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "game.sav")
+
+	r := fakeBankedROM(0x03, 4, 2)
+	if err := r.OpenSave(path); err != nil {
+		t.Fatal(err)
+	}
+	r.W(0x0000, 0x0a)
+	r.W(0xa010, 0x77)
+	if !r.ramDirty {
+		t.Errorf("expected RAM write to mark the save dirty\n")
+	}
+	if err := r.FlushSave(); err != nil {
+		t.Fatal(err)
+	}
+	if r.ramDirty {
+		t.Errorf("expected flush to clear dirty flag\n")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0x2000 || data[0x10] != 0x77 {
+		t.Errorf("save file has unexpected contents\n")
+	}
+
+	r2 := fakeBankedROM(0x03, 4, 2)
+	if err := r2.OpenSave(path); err != nil {
+		t.Fatal(err)
+	}
+	r2.W(0x0000, 0x0a)
+	if v := r2.R(0xa010); v != 0x77 {
+		t.Errorf("expected loaded save to read %02Xh, got %02Xh\n", 0x77, v)
+	}
+}
+
+func TestNoSaveWithoutBattery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blitzle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "game.sav")
+
+	r := fakeBankedROM(0x02, 4, 2)
+	if err := r.OpenSave(path); err != nil {
+		t.Fatal(err)
+	}
+	r.W(0x0000, 0x0a)
+	r.W(0xa010, 0x77)
+	if err := r.WriteSave(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no save file for a cart without a battery\n")
+	}
+}
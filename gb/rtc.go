@@ -0,0 +1,265 @@
+package gb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Where a cartridge real-time clock gets its time from.
+type RTCSource int
+
+const (
+	// Advance with the wall clock, even while the emulator isn't running.
+	RTCWallClock RTCSource = iota
+	// Advance with emulated cycles, so the clock runs at emulation speed and
+	// is deterministic.
+	RTCEmulated
+)
+
+const (
+	rtcSeconds uint8 = 0x08
+	rtcMinutes uint8 = 0x09
+	rtcHours   uint8 = 0x0a
+	rtcDaysLow uint8 = 0x0b
+	rtcDaysHi  uint8 = 0x0c
+)
+
+const rtcFooterSize int = 48
+
+/*
+ * The MBC3 real-time clock. The game reads a latched copy of the registers
+ * which is only updated when it writes 00h followed by 01h to 6000-7FFF, so
+ * the clock can't tick over while it's in the middle of reading it.
+ */
+type rtc struct {
+	source RTCSource
+	now    func() time.Time
+
+	seconds  uint8
+	minutes  uint8
+	hours    uint8
+	days     uint16 // 9 bits
+	halt     bool
+	dayCarry bool
+
+	latched     [5]uint8
+	latchPrimed bool
+
+	// Cycles towards the next second in RTCEmulated mode
+	cycles int
+	// When we last caught up in RTCWallClock mode
+	lastUpdate time.Time
+}
+
+func newRTC() *rtc {
+	c := &rtc{source: RTCWallClock, now: time.Now}
+	c.lastUpdate = c.now()
+	return c
+}
+
+func (c *rtc) setSource(src RTCSource) {
+	c.update()
+	c.source = src
+	c.lastUpdate = c.now()
+}
+
+// Step the clock along in RTCEmulated mode.
+func (c *rtc) step(cycles int) {
+	if c.source != RTCEmulated || c.halt {
+		return
+	}
+	c.cycles += cycles
+	for c.cycles >= int(clkFreq) {
+		c.cycles -= int(clkFreq)
+		c.advance(1)
+	}
+}
+
+// Catch up with the wall clock in RTCWallClock mode.
+func (c *rtc) update() {
+	if c.source != RTCWallClock {
+		return
+	}
+	now := c.now()
+	elapsed := now.Sub(c.lastUpdate)
+	if elapsed < time.Second {
+		return
+	}
+	secs := int64(elapsed / time.Second)
+	c.lastUpdate = c.lastUpdate.Add(time.Duration(secs) * time.Second)
+	if !c.halt {
+		c.advance(secs)
+	}
+}
+
+/*
+ * Move the clock forward. The hardware only checks for exact rollover values,
+ * so registers that were written with out of range values count all the way
+ * up to their bit width before wrapping to 0 without a carry. Do large jumps
+ * a minute at a time to keep that behavior without looping forever.
+ */
+func (c *rtc) advance(secs int64) {
+	for ; secs > 0 && c.seconds != 0; secs-- {
+		c.tickSecond()
+	}
+	for ; secs >= 60 && c.seconds == 0; secs -= 60 {
+		c.tickMinute()
+	}
+	for ; secs > 0; secs-- {
+		c.tickSecond()
+	}
+}
+
+func (c *rtc) tickSecond() {
+	c.seconds = (c.seconds + 1) & 0x3f
+	if c.seconds == 60 {
+		c.seconds = 0
+		c.tickMinute()
+	}
+}
+
+func (c *rtc) tickMinute() {
+	c.minutes = (c.minutes + 1) & 0x3f
+	if c.minutes != 60 {
+		return
+	}
+	c.minutes = 0
+	c.hours = (c.hours + 1) & 0x1f
+	if c.hours != 24 {
+		return
+	}
+	c.hours = 0
+	c.days++
+	if c.days == 512 {
+		c.days = 0
+		c.dayCarry = true
+	}
+}
+
+func (c *rtc) daysHigh() uint8 {
+	v := uint8(c.days>>8) & 0x01
+	if c.halt {
+		v |= 0x40
+	}
+	if c.dayCarry {
+		v |= 0x80
+	}
+	return v
+}
+
+func (c *rtc) current() [5]uint8 {
+	return [5]uint8{c.seconds, c.minutes, c.hours, uint8(c.days), c.daysHigh()}
+}
+
+// Writing 00h and then 01h latches the current time.
+func (c *rtc) latch(val uint8) {
+	if c.latchPrimed && val == 0x01 {
+		c.update()
+		c.latched = c.current()
+	}
+	c.latchPrimed = val == 0x00
+}
+
+func (c *rtc) R(reg uint8) uint8 {
+	return c.latched[reg-rtcSeconds]
+}
+
+func (c *rtc) W(reg uint8, val uint8) {
+	c.update()
+	switch reg {
+	case rtcSeconds:
+		c.seconds = val & 0x3f
+		c.cycles = 0
+	case rtcMinutes:
+		c.minutes = val & 0x3f
+	case rtcHours:
+		c.hours = val & 0x1f
+	case rtcDaysLow:
+		c.days = c.days&0x100 | uint16(val)
+	case rtcDaysHi:
+		c.days = c.days&0xff | uint16(val&0x01)<<8
+		c.halt = val&0x40 != 0
+		c.dayCarry = val&0x80 != 0
+	}
+	c.latched[reg-rtcSeconds] = c.current()[reg-rtcSeconds]
+}
+
+/*
+ * Save the clock in the 48 byte footer format most emulators append to save
+ * RAM: the five live registers and then the five latched registers, each as a
+ * little endian 32 bit value, followed by a 64 bit unix timestamp.
+ */
+func (c *rtc) marshal() []byte {
+	c.update()
+	o := make([]byte, rtcFooterSize)
+	for i, v := range c.current() {
+		binary.LittleEndian.PutUint32(o[i*4:], uint32(v))
+	}
+	for i, v := range c.latched {
+		binary.LittleEndian.PutUint32(o[20+i*4:], uint32(v))
+	}
+	binary.LittleEndian.PutUint64(o[40:], uint64(c.lastUpdate.Unix()))
+	return o
+}
+
+// Save states get the battery footer plus the bits that are only
+// interesting while we're running. The footer only keeps whole seconds, so
+// the exact time we last caught up goes in separately.
+func (c *rtc) saveState(w *stateWriter) {
+	w.write(c.marshal(), c.latchPrimed, int64(c.cycles), c.lastUpdate.UnixNano())
+}
+
+/*
+ * Unlike a battery save, a save state puts the clock back exactly as it was
+ * rather than catching up on the time since, so loading one (or rewinding)
+ * doesn't move the clock.
+ */
+func (c *rtc) loadState(r *stateReader) {
+	b := make([]byte, rtcFooterSize)
+	var cycles, lastUpdate int64
+	r.read(b, &c.latchPrimed, &cycles, &lastUpdate)
+	if r.err != nil {
+		return
+	}
+	if _, r.err = c.restore(b); r.err != nil {
+		return
+	}
+	c.cycles = int(cycles)
+	c.lastUpdate = time.Unix(0, lastUpdate)
+}
+
+func (c *rtc) unmarshal(b []byte) error {
+	saved, err := c.restore(b)
+	if err != nil {
+		return err
+	}
+
+	// Account for the time we were switched off.
+	c.lastUpdate = saved
+	c.update()
+	if c.source != RTCWallClock {
+		c.lastUpdate = c.now()
+	}
+	return nil
+}
+
+// Set the registers from a battery footer and return when it was written.
+func (c *rtc) restore(b []byte) (time.Time, error) {
+	if len(b) != rtcFooterSize {
+		return time.Time{}, fmt.Errorf("RTC footer is %d bytes, expected %d", len(b), rtcFooterSize)
+	}
+	var regs [10]uint8
+	for i := range regs {
+		regs[i] = uint8(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	c.seconds = regs[0] & 0x3f
+	c.minutes = regs[1] & 0x3f
+	c.hours = regs[2] & 0x1f
+	c.days = uint16(regs[3]) | uint16(regs[4]&0x01)<<8
+	c.halt = regs[4]&0x40 != 0
+	c.dayCarry = regs[4]&0x80 != 0
+	copy(c.latched[:], regs[5:])
+	c.cycles = 0
+	return time.Unix(int64(binary.LittleEndian.Uint64(b[40:])), 0), nil
+}
@@ -0,0 +1,193 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) now() time.Time {
+	return f.t
+}
+
+func rtcROM(t *testing.T, src RTCSource) (*ROM, *fakeClock) {
+	r := fakeBankedROM(0x10, 4, 3)
+	clock := &fakeClock{time.Unix(1000000, 0)}
+	m := r.mbc.(*mbc3)
+	m.clock.now = clock.now
+	m.clock.lastUpdate = clock.t
+	r.SetRTCSource(src)
+	// Enable RAM/clock access
+	r.W(0x0000, 0x0a)
+	return r, clock
+}
+
+func latchRTC(r *ROM) {
+	r.W(0x6000, 0x00)
+	r.W(0x6000, 0x01)
+}
+
+func checkRTC(t *testing.T, r *ROM, reg uint8, expected uint8) {
+	r.W(0x4000, reg)
+	if v := r.R(0xa000); v != expected {
+		t.Errorf("expected RTC register %02Xh to be %02Xh, got %02Xh\n", reg, expected, v)
+	}
+}
+
+func writeRTC(r *ROM, reg uint8, val uint8) {
+	r.W(0x4000, reg)
+	r.W(0xa000, val)
+}
+
+func TestRTCLatch(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	clock.t = clock.t.Add(5 * time.Second)
+	// Not latched yet, so still reads 0
+	checkRTC(t, r, rtcSeconds, 0)
+	latchRTC(r)
+	checkRTC(t, r, rtcSeconds, 5)
+	clock.t = clock.t.Add(5 * time.Second)
+	checkRTC(t, r, rtcSeconds, 5)
+	// Writing 01h without 00h first shouldn't latch
+	r.W(0x6000, 0x01)
+	checkRTC(t, r, rtcSeconds, 5)
+	latchRTC(r)
+	checkRTC(t, r, rtcSeconds, 10)
+}
+
+func TestRTCRollover(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	writeRTC(r, rtcSeconds, 59)
+	writeRTC(r, rtcMinutes, 59)
+	writeRTC(r, rtcHours, 23)
+	writeRTC(r, rtcDaysLow, 0xff)
+	writeRTC(r, rtcDaysHi, 0x01)
+	clock.t = clock.t.Add(time.Second)
+	latchRTC(r)
+
+	checkRTC(t, r, rtcSeconds, 0)
+	checkRTC(t, r, rtcMinutes, 0)
+	checkRTC(t, r, rtcHours, 0)
+	checkRTC(t, r, rtcDaysLow, 0)
+	checkRTC(t, r, rtcDaysHi, 0x80)
+}
+
+func TestRTCDayCounter(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	clock.t = clock.t.Add(300*24*time.Hour + 3*time.Hour + 2*time.Minute + time.Second)
+	latchRTC(r)
+
+	checkRTC(t, r, rtcSeconds, 1)
+	checkRTC(t, r, rtcMinutes, 2)
+	checkRTC(t, r, rtcHours, 3)
+	checkRTC(t, r, rtcDaysLow, uint8(300&0xff))
+	checkRTC(t, r, rtcDaysHi, 0x01)
+}
+
+func TestRTCInvalidSeconds(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	// Out of range values count up to the bit width and wrap without
+	// carrying into the minutes.
+	writeRTC(r, rtcSeconds, 62)
+	clock.t = clock.t.Add(2 * time.Second)
+	latchRTC(r)
+
+	checkRTC(t, r, rtcSeconds, 0)
+	checkRTC(t, r, rtcMinutes, 0)
+}
+
+func TestRTCHalt(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	writeRTC(r, rtcDaysHi, 0x40)
+	clock.t = clock.t.Add(time.Minute)
+	latchRTC(r)
+	checkRTC(t, r, rtcSeconds, 0)
+	checkRTC(t, r, rtcDaysHi, 0x40)
+
+	writeRTC(r, rtcDaysHi, 0x00)
+	clock.t = clock.t.Add(3 * time.Second)
+	latchRTC(r)
+	checkRTC(t, r, rtcSeconds, 3)
+}
+
+func TestRTCEmulated(t *testing.T) {
+	r, clock := rtcROM(t, RTCEmulated)
+
+	// Wall time shouldn't matter
+	clock.t = clock.t.Add(time.Hour)
+	for i := 0; i < int(clkFreq)*2/4; i++ {
+		r.mbc.(ClockedMBC).Step(4)
+	}
+	latchRTC(r)
+	checkRTC(t, r, rtcSeconds, 2)
+	checkRTC(t, r, rtcMinutes, 0)
+}
+
+func TestRTCBatteryRoundTrip(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+
+	r.W(0x4000, 0x00)
+	r.W(0xa000, 0x42)
+	writeRTC(r, rtcMinutes, 10)
+	latchRTC(r)
+
+	buf := &bytes.Buffer{}
+	if err := r.SaveBattery(buf); err != nil {
+		t.Fatal(err)
+	}
+	if l := buf.Len(); l != len(r.RAM())+rtcFooterSize {
+		t.Errorf("expected save of %d bytes, got %d\n", len(r.RAM())+rtcFooterSize, l)
+	}
+
+	// Load it into a fresh cart an hour later
+	r2, clock2 := rtcROM(t, RTCWallClock)
+	clock2.t = clock.t.Add(time.Hour)
+	if err := r2.LoadBattery(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2.W(0x4000, 0x00)
+	if v := r2.R(0xa000); v != 0x42 {
+		t.Errorf("expected RAM to be restored to %02Xh, got %02Xh\n", 0x42, v)
+	}
+	// The latched registers come back as they were
+	checkRTC(t, r2, rtcMinutes, 10)
+	latchRTC(r2)
+	checkRTC(t, r2, rtcMinutes, 10)
+	checkRTC(t, r2, rtcHours, 1)
+}
+
+func TestRTCStateRoundTrip(t *testing.T) {
+	r, clock := rtcROM(t, RTCWallClock)
+	c := r.mbc.(*mbc3).clock
+	c.lastUpdate = clock.t.Add(300 * time.Millisecond)
+	clock.t = clock.t.Add(90*time.Second + 500*time.Millisecond)
+	latchRTC(r)
+	saved := c.lastUpdate
+
+	buf := &bytes.Buffer{}
+	if err := r.mbc.(StatefulMBC).SaveState(buf); err != nil {
+		t.Fatal(err)
+	}
+	// Loading a state later on shouldn't move the clock
+	clock.t = clock.t.Add(time.Hour)
+	if err := r.mbc.(StatefulMBC).LoadState(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !c.lastUpdate.Equal(saved) {
+		t.Errorf("expected last update to be %v, got %v\n", saved, c.lastUpdate)
+	}
+	if c.seconds != 30 || c.minutes != 1 || c.hours != 0 {
+		t.Errorf("expected clock to be 0:01:30, got %d:%02d:%02d\n", c.hours, c.minutes, c.seconds)
+	}
+	checkRTC(t, r, rtcSeconds, 30)
+	checkRTC(t, r, rtcMinutes, 1)
+}
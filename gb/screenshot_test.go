@@ -0,0 +1,230 @@
+package gb
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type Screen [LCDSizeX * LCDSizeY]Pixel
+
+// Keeps the last frame it was sent.
+type ScreenshotVideoSwapper struct {
+	screen Screen
+	frames int
+}
+
+func (s *ScreenshotVideoSwapper) VideoSwap(pixels [LCDSizeX * LCDSizeY]Pixel) {
+	s.screen = pixels
+	s.frames++
+}
+
+// The shades reference screenshots use, lightest first.
+var screenshotShades = [4]uint8{0xff, 0xaa, 0x55, 0x00}
+
+var screenshotDiffColor = color.RGBA{0xff, 0x00, 0x00, 0xff}
+
+/*
+ * ROMs we check against a reference screenshot, relative to the test
+ * directory. A non-empty known failure skips rather than fails on a
+ * mismatch. 01-special's reference came from this emulator, so it only
+ * catches regressions in the background. dmg-acid2's is the one from
+ * https://github.com/mattcurrie/dmg-acid2, taken from real hardware. It
+ * isn't checked in yet, so it fails until the ROM and reference-dmg.png are
+ * put in third_party/dmg-acid2 and a run says whether it needs a known
+ * failure.
+ */
+var screenshotROMs = []struct {
+	rom    string
+	ref    string
+	frames int
+	known  string
+}{
+	{
+		"../third_party/gblargg/cpu_instrs/individual/01-special.gb",
+		"testdata/screenshots/01-special.png",
+		180,
+		"",
+	},
+	{
+		"../third_party/dmg-acid2/dmg-acid2.gb",
+		"../third_party/dmg-acid2/reference-dmg.png",
+		120,
+		"",
+	},
+}
+
+// Run a ROM for the given number of frames and grab the last one.
+func runScreenshot(r *ROM, frames int) Screen {
+	sys := NewSys(r)
+	swapper := &ScreenshotVideoSwapper{}
+	sys.SetVideoSwapper(swapper)
+	for i := 0; i < frames; i++ {
+		sys.RunFrame()
+	}
+	return swapper.screen
+}
+
+// Map each pixel to whichever of the four shades its grey level is closest to.
+func loadScreenshot(path string) (Screen, error) {
+	var s Screen
+	f, err := os.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return s, err
+	}
+	b := img.Bounds()
+	if b.Dx() != int(LCDSizeX) || b.Dy() != int(LCDSizeY) {
+		return s, fmt.Errorf("screenshot is %dx%d, expected %dx%d", b.Dx(), b.Dy(), LCDSizeX, LCDSizeY)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			grey := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			s[uint(y)*LCDSizeX+uint(x)] = Pixel(3 - (int(grey)+42)/85)
+		}
+	}
+	return s, nil
+}
+
+func screenshotImage(s Screen) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, int(LCDSizeX), int(LCDSizeY)))
+	for i, p := range s {
+		shade := screenshotShades[p&3]
+		img.Set(i%int(LCDSizeX), i/int(LCDSizeX), color.RGBA{shade, shade, shade, 0xff})
+	}
+	return img
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/*
+ * Count the pixels that differ. If any do, write what we got with the
+ * differing pixels in red to diffPath so it's easy to see what went wrong.
+ */
+func compareScreenshot(got Screen, expected Screen, diffPath string) (int, error) {
+	img := screenshotImage(got)
+	diffs := 0
+	for i := range got {
+		if got[i] != expected[i] {
+			img.Set(i%int(LCDSizeX), i/int(LCDSizeX), screenshotDiffColor)
+			diffs++
+		}
+	}
+	if diffs == 0 {
+		return 0, nil
+	}
+	return diffs, writePNG(diffPath, img)
+}
+
+func TestScreenshots(t *testing.T) {
+	for _, rom := range screenshotROMs {
+		rom := rom
+		name := filepath.Base(rom.rom)
+		t.Run(name, func(t *testing.T) {
+			expected, err := loadScreenshot(rom.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := LoadROMFromFile(rom.rom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := runScreenshot(r, rom.frames)
+			diffPath := filepath.Join(os.TempDir(), name+"-diff.png")
+			diffs, err := compareScreenshot(got, expected, diffPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case diffs == 0 && rom.known != "":
+				t.Logf("ROM %s passes now, remove its known failure\n", name)
+			case diffs != 0 && rom.known != "":
+				t.Skipf("ROM %s is a known failure (%s): %d pixels differ\n", name, rom.known, diffs)
+			case diffs != 0:
+				t.Errorf("ROM %s: %d pixels differ\n", name, diffs)
+			}
+		})
+	}
+}
+
+func TestScreenshotCompare(t *testing.T) {
+	var s Screen
+	for i := range s {
+		s[i] = Pixel(i % 4)
+	}
+	dir, err := ioutil.TempDir("", "blitzle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Shades should survive a round trip through a PNG
+	refPath := filepath.Join(dir, "ref.png")
+	if err := writePNG(refPath, screenshotImage(s)); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := loadScreenshot(refPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffPath := filepath.Join(dir, "diff.png")
+	if diffs, err := compareScreenshot(s, ref, diffPath); err != nil || diffs != 0 {
+		t.Errorf("expected no differences, got %d (%v)\n", diffs, err)
+	}
+	if _, err := os.Stat(diffPath); err == nil {
+		t.Errorf("expected no diff image for a match\n")
+	}
+
+	s[5] = 3 - s[5]
+	s[LCDSizeX*LCDSizeY-1] = 3 - s[LCDSizeX*LCDSizeY-1]
+	if diffs, err := compareScreenshot(s, ref, diffPath); err != nil || diffs != 2 {
+		t.Errorf("expected 2 differences, got %d (%v)\n", diffs, err)
+	}
+	f, err := os.Open(diffPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	diff, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, _, _ := diff.At(5, 0).RGBA(); r != 0xffff || g != 0 {
+		t.Errorf("expected the differing pixel to be red\n")
+	}
+}
+
+func TestScreenshotRun(t *testing.T) {
+	// Just spin with the LCD on and VRAM empty, which is a blank screen
+	sys := S([]byte{0x18, 0xfe})
+	swapper := &ScreenshotVideoSwapper{}
+	sys.SetVideoSwapper(swapper)
+	swapper.screen[0] = 3
+	sys.RunFrame()
+	sys.RunFrame()
+	if swapper.frames != 2 {
+		t.Errorf("expected 2 frames, got %d\n", swapper.frames)
+	}
+	if swapper.screen != (Screen{}) {
+		t.Errorf("expected a blank screen\n")
+	}
+}
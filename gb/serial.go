@@ -18,6 +18,8 @@ type Serial struct {
 	transferDone       chan bool
 	transferInProgress bool
 	newSb              uint8
+	// Set when a loaded state had a transfer in progress
+	finishTransfer bool
 }
 
 func NewSerial() *Serial {
@@ -27,21 +29,43 @@ func NewSerial() *Serial {
 		0,
 		make(chan bool),
 		false,
-		0}
+		0,
+		false}
 }
 
 func (s *Serial) Step(sys *Sys) {
-	if s.transferInProgress {
-		select {
-		case <-s.transferDone:
-			s.transferInProgress = false
-			s.sb = s.newSb
-			sys.RaiseInterrupt(SerialInterrupt)
-		default:
-		}
+	if !s.transferInProgress {
+		return
+	}
+	if s.finishTransfer {
+		s.finishTransfer = false
+		s.completeTransfer(sys)
+		return
+	}
+	select {
+	case <-s.transferDone:
+		s.completeTransfer(sys)
+	default:
 	}
 }
 
+func (s *Serial) completeTransfer(sys *Sys) {
+	s.transferInProgress = false
+	s.sb = s.newSb
+	sys.RaiseInterrupt(SerialInterrupt)
+}
+
+func (s *Serial) saveState(w *stateWriter) {
+	w.write(s.sb, s.sc, s.transferInProgress, s.newSb)
+}
+
+func (s *Serial) loadState(r *stateReader) {
+	r.read(&s.sb, &s.sc, &s.transferInProgress, &s.newSb)
+	// Nothing is swapping on our behalf anymore, so finish the transfer
+	// on the next step with whatever we'd got back when the state was saved
+	s.finishTransfer = s.transferInProgress
+}
+
 func (s *Serial) R(addr uint16) uint8 {
 	switch addr {
 	case sbAddr:
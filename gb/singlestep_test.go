@@ -0,0 +1,257 @@
+package gb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * Single step tests run one instruction from a known state and check the
+ * registers, memory and every bus cycle it made. The vectors are JSON files
+ * with an array of tests each, in the same format as the sm83 tests from
+ * https://github.com/SingleStepTests/sm83:
+ *
+ *   {"name": "...",
+ *    "initial": {"pc": ..., "sp": ..., "a": ..., "f": ..., ...,
+ *                "ime": 0, "ram": [[addr, val], ...]},
+ *    "final": {...},
+ *    "cycles": [[addr, val, "r-m"], [addr, val, "-wm"], null, ...]}
+ *
+ * The PC starts on the opcode, and each entry in cycles is one machine cycle,
+ * null for the ones that don't touch the bus. Ours live in testdata/cpu, one
+ * file for every opcode, and are made by testdata/cpu/gen.go. That's a second
+ * model of the CPU, so it checks its flags against the published opcode
+ * tables, and TestInstrTiming checks cycle counts against instr_timing's.
+ * Neither catches everything a shared misreading could, so a checked subset
+ * of the published vectors should go alongside ours when it can be fetched.
+ */
+
+type singleStepState struct {
+	PC  uint16     `json:"pc"`
+	SP  uint16     `json:"sp"`
+	A   uint8      `json:"a"`
+	B   uint8      `json:"b"`
+	C   uint8      `json:"c"`
+	D   uint8      `json:"d"`
+	E   uint8      `json:"e"`
+	F   uint8      `json:"f"`
+	H   uint8      `json:"h"`
+	L   uint8      `json:"l"`
+	IME uint8      `json:"ime"`
+	RAM [][2]int32 `json:"ram"`
+}
+
+type singleStepTest struct {
+	Name    string            `json:"name"`
+	Initial singleStepState   `json:"initial"`
+	Final   singleStepState   `json:"final"`
+	Cycles  []json.RawMessage `json:"cycles"`
+}
+
+type busCycle struct {
+	addr  uint16
+	val   uint8
+	write bool
+	// Nothing on the bus this cycle, so addr and val mean nothing
+	internal bool
+}
+
+func (b busCycle) String() string {
+	switch {
+	case b.internal:
+		return "internal"
+	case b.write:
+		return fmt.Sprintf("W %02Xh => (%04Xh)", b.val, b.addr)
+	}
+	return fmt.Sprintf("R (%04Xh) => %02Xh", b.addr, b.val)
+}
+
+func parseBusCycle(raw json.RawMessage) (busCycle, error) {
+	var c []interface{}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return busCycle{}, err
+	}
+	if c == nil {
+		return busCycle{internal: true}, nil
+	}
+	if len(c) != 3 {
+		return busCycle{}, fmt.Errorf("bad cycle %s", raw)
+	}
+	addr, okAddr := c[0].(float64)
+	val, okVal := c[1].(float64)
+	kind, okKind := c[2].(string)
+	if !okAddr || !okVal || !okKind {
+		return busCycle{}, fmt.Errorf("bad cycle %s", raw)
+	}
+	return busCycle{
+		uint16(addr),
+		uint8(val),
+		strings.Contains(kind, "w"),
+		!strings.ContainsAny(kind, "rw"),
+	}, nil
+}
+
+/*
+ * 64k of RAM and nothing else, which logs every access along with the
+ * machine cycle it happened in.
+ */
+type FlatBus struct {
+	sys       *Sys
+	mem       [0x10000]uint8
+	startWall int
+	cycles    []busCycle
+}
+
+func (f *FlatBus) log(c busCycle) {
+	// The CPU ticks right before it accesses the bus
+	n := (f.sys.Wall - f.startWall) / 4
+	for len(f.cycles) < n-1 {
+		f.cycles = append(f.cycles, busCycle{internal: true})
+	}
+	f.cycles = append(f.cycles, c)
+}
+
+func (f *FlatBus) R(addr uint16) uint8 {
+	f.log(busCycle{addr, f.mem[addr], false, false})
+	return f.mem[addr]
+}
+
+func (f *FlatBus) W(addr uint16, val uint8) {
+	f.log(busCycle{addr, val, true, false})
+	f.mem[addr] = val
+}
+
+func (f *FlatBus) Asserts(addr uint16) bool {
+	return true
+}
+
+// A Sys with the CPU hooked up to nothing but a FlatBus.
+func flatSys() (*Sys, *FlatBus) {
+	sys := NewSys(FakeROM([]byte{}))
+	bus := &FlatBus{sys: sys}
+	sys.devs = []BusDev{bus}
+	// These aren't on the bus anymore, so make sure they stay out of the way
+	sys.ieReg.set(0)
+	sys.ifReg.set(0)
+	return sys, bus
+}
+
+func setSingleStepState(sys *Sys, bus *FlatBus, s *singleStepState) {
+	c := sys.cpu
+	c.ip, c.sp = s.PC, s.SP
+	c.a, c.b, c.c, c.d, c.e, c.h, c.l = s.A, s.B, s.C, s.D, s.E, s.H, s.L
+	c.setFlags(s.F)
+	c.interrupts = s.IME != 0
+	for _, m := range s.RAM {
+		bus.mem[uint16(m[0])] = uint8(m[1])
+	}
+}
+
+// Describe everything that doesn't match the expected state.
+func checkSingleStepState(sys *Sys, bus *FlatBus, s *singleStepState) []string {
+	var errs []string
+	check := func(name string, got int, expected int) {
+		if got != expected {
+			errs = append(errs, fmt.Sprintf("expected %s=%02Xh, got %02Xh", name, expected, got))
+		}
+	}
+	c := sys.cpu
+	check("PC", int(c.ip), int(s.PC))
+	check("SP", int(c.sp), int(s.SP))
+	check("A", int(c.a), int(s.A))
+	check("B", int(c.b), int(s.B))
+	check("C", int(c.c), int(s.C))
+	check("D", int(c.d), int(s.D))
+	check("E", int(c.e), int(s.E))
+	check("F", int(c.flags()), int(s.F))
+	check("H", int(c.h), int(s.H))
+	check("L", int(c.l), int(s.L))
+	ime := 0
+	if c.interrupts {
+		ime = 1
+	}
+	check("IME", ime, int(s.IME))
+	for _, m := range s.RAM {
+		check(fmt.Sprintf("(%04Xh)", m[0]), int(bus.mem[uint16(m[0])]), int(m[1]))
+	}
+	return errs
+}
+
+func runSingleStepTest(test *singleStepTest) []string {
+	sys, bus := flatSys()
+	setSingleStepState(sys, bus, &test.Initial)
+	bus.startWall = sys.Wall
+	sys.Step()
+	// Pad out any internal cycles at the end
+	for len(bus.cycles) < (sys.Wall-bus.startWall)/4 {
+		bus.cycles = append(bus.cycles, busCycle{internal: true})
+	}
+
+	errs := checkSingleStepState(sys, bus, &test.Final)
+	if len(bus.cycles) != len(test.Cycles) {
+		errs = append(errs, fmt.Sprintf("expected %d cycles, got %d", len(test.Cycles), len(bus.cycles)))
+	}
+	for i := 0; i < len(bus.cycles) && i < len(test.Cycles); i++ {
+		expected, err := parseBusCycle(test.Cycles[i])
+		if err != nil {
+			return append(errs, err.Error())
+		}
+		if expected != bus.cycles[i] {
+			errs = append(errs, fmt.Sprintf("expected cycle %d to be %v, got %v", i, expected, bus.cycles[i]))
+		}
+	}
+	return errs
+}
+
+func loadSingleStepTests(path string) ([]singleStepTest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tests []singleStepTest
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return tests, nil
+}
+
+func runSingleStepFiles(t *testing.T, pattern string) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no tests matching %s\n", pattern)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			tests, err := loadSingleStepTests(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failures := 0
+			for i := range tests {
+				errs := runSingleStepTest(&tests[i])
+				if len(errs) == 0 {
+					continue
+				}
+				// Some files have thousands of tests, and they tend
+				// to fail for the same reason
+				if failures++; failures <= 5 {
+					t.Errorf("%s:\n  %s\n", tests[i].Name, strings.Join(errs, "\n  "))
+				}
+			}
+			if failures > 5 {
+				t.Errorf("and %d more failures\n", failures-5)
+			}
+		})
+	}
+}
+
+func TestSingleStep(t *testing.T) {
+	runSingleStepFiles(t, filepath.Join("testdata", "cpu", "*.json"))
+}
@@ -0,0 +1,152 @@
+package gb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+ * Save states are a magic string and format version followed by every
+ * component's state in a fixed order, all little endian. Bump stateVersion
+ * whenever anything is added, removed or reordered; we refuse to load states
+ * from other versions rather than guess.
+ */
+const stateMagic = "BLTZ"
+const stateVersion uint32 = 12
+
+// Accumulates the first error so callers can write a whole component and
+// only check once at the end.
+type stateWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *stateWriter) write(vals ...interface{}) {
+	for _, v := range vals {
+		if s.err != nil {
+			return
+		}
+		s.err = binary.Write(s.w, binary.LittleEndian, v)
+	}
+}
+
+// Write a length-prefixed blob.
+func (s *stateWriter) blob(b []byte) {
+	s.write(uint32(len(b)))
+	s.write(b)
+}
+
+type stateReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *stateReader) read(ptrs ...interface{}) {
+	for _, p := range ptrs {
+		if s.err != nil {
+			return
+		}
+		s.err = binary.Read(s.r, binary.LittleEndian, p)
+	}
+}
+
+// Read a length-prefixed blob.
+func (s *stateReader) blob() []byte {
+	var l uint32
+	s.read(&l)
+	if s.err != nil {
+		return nil
+	}
+	b := make([]byte, l)
+	_, s.err = io.ReadFull(s.r, b)
+	return b
+}
+
+// Read a length-prefixed blob that must be exactly as long as dst.
+func (s *stateReader) blobInto(dst []byte, what string) {
+	b := s.blob()
+	if s.err != nil {
+		return
+	}
+	if len(b) != len(dst) {
+		s.err = fmt.Errorf("%s is %d bytes in state, expected %d", what, len(b), len(dst))
+		return
+	}
+	copy(dst, b)
+}
+
+// Write a snapshot of the whole system.
+func (s *Sys) SaveState(w io.Writer) error {
+	sw := &stateWriter{w: w}
+	sw.write([]byte(stateMagic), stateVersion)
+	sw.write(int64(s.Wall), s.Stop)
+	s.cpu.saveState(sw)
+	sw.write(s.ieReg.val(), s.ifReg.val())
+	sw.blob(s.systemRAM.ram.data)
+	sw.blob(s.hiRAM.data)
+	s.video.saveState(sw)
+	s.timer.saveState(sw)
+	s.joypad.saveState(sw)
+	s.serial.saveState(sw)
+	s.apu.saveState(sw)
+	s.rom.saveState(sw)
+	return sw.err
+}
+
+/*
+ * Restore a snapshot written by SaveState. If the state can't be loaded the
+ * system is left as it was, unless putting it back fails too, which the
+ * error says.
+ */
+func (s *Sys) LoadState(r io.Reader) error {
+	backup := &bytes.Buffer{}
+	if err := s.SaveState(backup); err != nil {
+		return err
+	}
+	dirty := s.rom.ramDirty
+	if err := s.loadState(r); err != nil {
+		if rerr := s.loadState(backup); rerr != nil {
+			return fmt.Errorf("failed to load state (%v) or restore the old one (%v), so the system may be inconsistent", err, rerr)
+		}
+		// Putting things back doesn't count as a change to the save
+		s.rom.ramDirty = dirty
+		return err
+	}
+	return nil
+}
+
+func (s *Sys) loadState(r io.Reader) error {
+	sr := &stateReader{r: r}
+	magic := make([]byte, len(stateMagic))
+	var version uint32
+	sr.read(magic, &version)
+	if sr.err != nil {
+		return sr.err
+	}
+	if string(magic) != stateMagic {
+		return fmt.Errorf("not a save state")
+	}
+	if version != stateVersion {
+		return fmt.Errorf("save state is version %d, expected %d", version, stateVersion)
+	}
+
+	var wall int64
+	var ie, iflag uint8
+	sr.read(&wall, &s.Stop)
+	s.Wall = int(wall)
+	s.cpu.loadState(sr)
+	sr.read(&ie, &iflag)
+	s.ieReg.set(ie)
+	s.ifReg.set(iflag)
+	sr.blobInto(s.systemRAM.ram.data, "system RAM")
+	sr.blobInto(s.hiRAM.data, "high RAM")
+	s.video.loadState(sr)
+	s.timer.loadState(sr)
+	s.joypad.loadState(sr)
+	s.serial.loadState(sr)
+	s.apu.loadState(sr)
+	s.rom.loadState(sr)
+	return sr.err
+}
@@ -0,0 +1,157 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+)
+
+const stateTestROM = "../third_party/gblargg/cpu_instrs/individual/01-special.gb"
+
+func loadTestSys(t *testing.T, fn string) *Sys {
+	r, err := LoadROMFromFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSys(r)
+}
+
+func saveStateBytes(t *testing.T, s *Sys) []byte {
+	buf := &bytes.Buffer{}
+	if err := s.SaveState(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	s.SetSerialSwapper(&BufferSerialSwapper{})
+	for i := 0; i < 500000; i++ {
+		s.Step()
+	}
+	snapshot := saveStateBytes(t, s)
+	for i := 0; i < 500000; i++ {
+		s.Step()
+	}
+	expected := saveStateBytes(t, s)
+
+	// Loading into a fresh system and running the same amount should
+	// land us in exactly the same place.
+	s2 := loadTestSys(t, stateTestROM)
+	s2.SetSerialSwapper(&BufferSerialSwapper{})
+	if err := s2.LoadState(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	if got := saveStateBytes(t, s2); !bytes.Equal(got, snapshot) {
+		t.Errorf("expected loaded state to match the saved one\n")
+	}
+	for i := 0; i < 500000; i++ {
+		s2.Step()
+	}
+	if got := saveStateBytes(t, s2); !bytes.Equal(got, expected) {
+		t.Errorf("expected state after running from snapshot to match\n")
+	}
+}
+
+func TestLoadStateRejectsBadStates(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	for i := 0; i < 1000; i++ {
+		s.Step()
+	}
+	good := saveStateBytes(t, s)
+
+	badMagic := append([]byte{}, good...)
+	badMagic[0] = 'X'
+	badVersion := append([]byte{}, good...)
+	badVersion[len(stateMagic)]++
+	truncated := good[:len(good)/2]
+
+	for name, state := range map[string][]byte{
+		"bad magic":   badMagic,
+		"bad version": badVersion,
+		"truncated":   truncated,
+	} {
+		before := saveStateBytes(t, s)
+		if err := s.LoadState(bytes.NewReader(state)); err == nil {
+			t.Errorf("expected %s state to fail to load\n", name)
+		}
+		if after := saveStateBytes(t, s); !bytes.Equal(before, after) {
+			t.Errorf("expected failed %s load to leave the system alone\n", name)
+		}
+	}
+}
+
+func TestLoadStateRejectsOtherCartridge(t *testing.T) {
+	s := loadTestSys(t, stateTestROM)
+	state := saveStateBytes(t, s)
+
+	other := loadTestSys(t, "../third_party/gblargg/cpu_instrs/individual/03-op sp,hl.gb")
+	if err := other.LoadState(bytes.NewReader(state)); err == nil {
+		t.Errorf("expected state from another cartridge to fail to load\n")
+	}
+}
+
+func TestMBCStateRoundTrip(t *testing.T) {
+	for _, cartType := range []byte{0x03, 0x06, 0x10, 0x1b} {
+		r := fakeBankedROM(cartType, 64, 3)
+		s := NewSys(r)
+		s.Wb(0x0000, 0x0a)
+		s.Wb(0x2100, 0x05)
+		s.Wb(0xa000, 0x03)
+		state := saveStateBytes(t, s)
+
+		r2 := fakeBankedROM(cartType, 64, 3)
+		s2 := NewSys(r2)
+		if err := s2.LoadState(bytes.NewReader(state)); err != nil {
+			t.Fatal(err)
+		}
+		if v := s2.Rb(0x4000); v != 0x05 {
+			t.Errorf("cart %02Xh: expected bank %02Xh after load, got %02Xh\n", cartType, 0x05, v)
+		}
+		if v := s2.Rb(0xa000) & 0x0f; v != 0x03 {
+			t.Errorf("cart %02Xh: expected RAM to read %02Xh after load, got %02Xh\n", cartType, 0x03, v)
+		}
+	}
+}
+
+func TestSerialStateRoundTrip(t *testing.T) {
+	s := NewSys(FakeROM([]byte{}))
+	s.serial.sb = 0x12
+	s.serial.transferInProgress = true
+	s.serial.newSb = 0x34
+	state := saveStateBytes(t, s)
+
+	// The transfer should finish with what it got back before the save
+	s2 := NewSys(FakeROM([]byte{}))
+	if err := s2.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+	if v := s2.Rb(scAddr); v&0x80 == 0 {
+		t.Errorf("expected transfer to still be in progress after load\n")
+	}
+	s2.serial.Step(s2)
+	if v := s2.Rb(sbAddr); v != 0x34 {
+		t.Errorf("expected SB to be %02Xh after the transfer, got %02Xh\n", 0x34, v)
+	}
+	if s2.ifReg.val()&(1<<SerialInterrupt) == 0 {
+		t.Errorf("expected serial interrupt after the transfer\n")
+	}
+}
+
+func TestLoadStateDirtiesSave(t *testing.T) {
+	s := NewSys(fakeBankedROM(0x03, 4, 2))
+	state := saveStateBytes(t, s)
+
+	if err := s.LoadState(bytes.NewReader(state[:len(state)/2])); err == nil {
+		t.Fatalf("expected truncated state to fail to load\n")
+	}
+	if s.rom.ramDirty {
+		t.Errorf("expected failed load to leave the save clean\n")
+	}
+	if err := s.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.rom.ramDirty {
+		t.Errorf("expected load to mark the save dirty\n")
+	}
+}
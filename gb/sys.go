@@ -2,8 +2,8 @@ package gb
 
 import (
 	"fmt"
-	"github.com/veandco/go-sdl2/sdl"
 	"log"
+	"sync/atomic"
 )
 
 // Main clock frequency (in Hz)
@@ -21,16 +21,35 @@ type Sys struct {
 	timer  *Timer
 	joypad *Joypad
 	serial *Serial
+	apu    *APU
 
 	devs []BusDev
 	Stop bool
 
-	Wall    int
-	cpuWait int
+	Wall int
 
 	Debug bool
+
+	// Set (atomically) to make Run return
+	quit int32
+	// Functions waiting to be run by Run between steps
+	queued chan func(*Sys)
+
+	frameHooks []FrameHook
+	// Number of frames finished so far
+	frames int
+
+	opcodeHook OpcodeHook
 }
 
+// Called at the start of every VBlank, once everything else for the step
+// that got us there is done.
+type FrameHook func(sys *Sys)
+
+// Called with every opcode the CPU fetches and the address it came from,
+// before it's run. CB-prefixed instructions only show up as the CBh.
+type OpcodeHook func(sys *Sys, addr uint16, opcode uint8)
+
 type BusDev interface {
 	R(addr uint16) uint8
 	W(addr uint16, val uint8)
@@ -67,6 +86,7 @@ func NewSys(rom *ROM) *Sys {
 	timer := NewTimer()
 	joypad := NewJoypad()
 	serial := NewSerial()
+	apu := NewAPU()
 	bh2 := NewBusHole(0xfea0, 0xff7f)
 	devs := []BusDev{
 		rom,
@@ -78,6 +98,7 @@ func NewSys(rom *ROM) *Sys {
 		timer,
 		joypad,
 		serial,
+		apu,
 		bh2}
 
 	s := &Sys{
@@ -91,11 +112,16 @@ func NewSys(rom *ROM) *Sys {
 		timer,
 		joypad,
 		serial,
+		apu,
 		devs,
 		false,
 		0,
+		false,
+		0,
+		make(chan func(*Sys), 16),
+		nil,
 		0,
-		false}
+		nil}
 	s.SetPostBootloaderState()
 
 	return s
@@ -105,34 +131,116 @@ func (s *Sys) IER() uint8 {
 	return s.Rb(0xffff)
 }
 
+// Run until Quit is called.
 func (s *Sys) Run() {
+	nextCheck := s.Wall
+	for atomic.LoadInt32(&s.quit) == 0 {
+		s.Step()
+		// Checking the queue is relatively expensive, so only do it
+		// once a frame.
+		if s.Wall >= nextCheck {
+			s.runQueued()
+			nextCheck = s.Wall + totalCycles
+		}
+	}
+}
+
+/*
+ * Queue f to be run on the goroutine calling Run. This is the only safe way
+ * to poke at the system (like saving or loading state) from another
+ * goroutine while it's running.
+ */
+func (s *Sys) Do(f func(*Sys)) {
+	s.queued <- f
+}
+
+func (s *Sys) runQueued() {
 	for {
+		select {
+		case f := <-s.queued:
+			f(s)
+		default:
+			return
+		}
+	}
+}
+
+/*
+ * Run until the next frame is finished. If the LCD is off there won't be
+ * one, so give up after a frame's worth of cycles.
+ */
+func (s *Sys) RunFrame() {
+	start := s.frames
+	end := s.Wall + totalCycles
+	for s.frames == start && s.Wall < end {
 		s.Step()
 	}
 }
 
-// Step four clock cycls.
+// Run for at least n clock cycles. This stops at the end of an instruction,
+// so it may overshoot a little.
+func (s *Sys) RunCycles(n int) {
+	end := s.Wall + n
+	for s.Wall < end {
+		s.Step()
+	}
+}
+
+// Run until done returns true. It is checked after every step.
+func (s *Sys) RunUntil(done func(*Sys) bool) {
+	for !done(s) {
+		s.Step()
+	}
+}
+
+// Make Run return. This is safe to call from any goroutine.
+func (s *Sys) Quit() {
+	atomic.StoreInt32(&s.quit, 1)
+}
+
+/*
+ * Run a single CPU instruction (or a single machine cycle if it's halted).
+ * The rest of the system is ticked along as the instruction accesses memory,
+ * and then for any cycles it spends doing other things.
+ */
 func (s *Sys) Step() {
-	// XXX(gerow): sys should NOT need to know ANYTHING about sdl
-	if s.Wall%(vblankCycles*144) == 0 {
-		sdl.PumpEvents()
+	cycles := s.cpu.Step(s)
+	for s.cpu.ticked < cycles {
+		s.cpu.tick(s)
+	}
+	if s.Debug {
+		fmt.Print(s.cpu.State(s))
+	}
+	//fmt.Printf(s.timer.State())
+	//fmt.Print(s.video.State(s))
+	if s.video.frameDone {
+		s.video.frameDone = false
+		s.frames++
+		for _, hook := range s.frameHooks {
+			hook(s)
+		}
 	}
+}
+
+// Run everything but the CPU for one machine cycle.
+func (s *Sys) tick() {
 	s.timer.Step(s)
+	s.rom.Step(s)
 	s.serial.Step(s)
 	s.video.Step(s)
-	if s.cpuWait == 0 {
-		s.cpuWait = s.cpu.Step(s)
-		if s.Debug {
-			fmt.Print(s.cpu.State(s))
-		}
-		//fmt.Printf(s.timer.State())
-		//fmt.Print(s.video.State(s))
-	} else {
-		s.cpuWait -= 4
-	}
+	s.apu.Step(s)
 	s.Wall += 4
 }
 
+func (s *Sys) AddFrameHook(hook FrameHook) {
+	s.frameHooks = append(s.frameHooks, hook)
+}
+
+// Only one hook can be set at a time, pass nil to remove it.
+func (s *Sys) SetOpcodeHook(hook OpcodeHook) {
+	s.opcodeHook = hook
+}
+
 /*
  * This only really works for values that divide evenly with the main clock,
  * but luckily those are all the values we need!
@@ -201,6 +309,8 @@ func (s *Sys) Ws(addr uint16, val uint16) {
 
 func (s *Sys) SetPostBootloaderState() {
 	s.cpu.SetPostBootloaderState(s)
+	s.timer.SetPostBootloaderState()
+	s.apu.SetPostBootloaderState()
 }
 
 func (s *Sys) WriteBytes(bytes []byte, addr uint16) {
@@ -246,6 +356,11 @@ func (s *Sys) RaiseInterrupt(inter Interrupt) {
 	s.ifReg.set(s.ifReg.val() | (1 << inter))
 }
 
+// Whether any enabled interrupt has been requested.
+func (s *Sys) InterruptPending() bool {
+	return s.ifReg.val()&s.ieReg.val()&0x1f != 0
+}
+
 func (s *Sys) HandleInterrupt() *Interrupt {
 	// Mask the current interrupts with the entabled mask
 	firingInterrupts := s.ifReg.val() & s.ieReg.val()
@@ -273,6 +388,26 @@ func (s *Sys) SetSerialSwapper(serialSwapper SerialSwapper) {
 	s.serial.swapper = serialSwapper
 }
 
+func (s *Sys) SetAudioSink(sink AudioSink) {
+	s.apu.setSink(sink)
+}
+
+/*
+ * Only let the channels in mask (made up of AudioSquare1 and friends) through
+ * to the audio sink. This applies to recordings too.
+ */
+func (s *Sys) SetAudioChannelMask(mask uint8) {
+	s.apu.setChannelMask(mask)
+}
+
+func (s *Sys) AudioChannelMask() uint8 {
+	return s.apu.channelMask
+}
+
+func (s *Sys) SetRumbler(rumbler Rumbler) {
+	s.rom.rumbler = rumbler
+}
+
 type UpdateButtonser interface {
 	UpdateButtons(state ButtonState)
 }
@@ -63,4 +63,91 @@ func TestCorrectThingAsserts(t *testing.T) {
 			t.Errorf("expected %04Xh to be handled by timer, got %+v\n", addr, s.getHandler(addr))
 		}
 	}
+	for addr := uint(0xff10); addr < 0xff40; addr++ {
+		if s.getHandler(uint16(addr)) != s.apu {
+			t.Errorf("expected %04Xh to be handled by apu\n", addr)
+		}
+	}
+}
+
+func TestRunCycles(t *testing.T) {
+	s := S([]byte{})
+	s.RunCycles(1000)
+	if s.Wall != 1000 {
+		t.Errorf("expected Wall=%d, got %d\n", 1000, s.Wall)
+	}
+	s.RunCycles(2)
+	if s.Wall != 1004 {
+		t.Errorf("expected Wall=%d, got %d\n", 1004, s.Wall)
+	}
+}
+
+func TestRunFrame(t *testing.T) {
+	s := S([]byte{})
+	s.RunFrame()
+	if s.frames != 1 {
+		t.Errorf("expected 1 frame, got %d\n", s.frames)
+	}
+	start := s.Wall
+	s.RunFrame()
+	if s.frames != 2 {
+		t.Errorf("expected 2 frames, got %d\n", s.frames)
+	}
+	if s.Wall-start != totalCycles {
+		t.Errorf("expected a frame to take %d cycles, took %d\n", totalCycles, s.Wall-start)
+	}
+}
+
+func TestRunFrameLCDOff(t *testing.T) {
+	s := S([]byte{})
+	s.Wb(0xff40, 0x00)
+	s.RunFrame()
+	if s.frames != 0 {
+		t.Errorf("expected no frames with the LCD off, got %d\n", s.frames)
+	}
+	if s.Wall != totalCycles {
+		t.Errorf("expected Wall=%d, got %d\n", totalCycles, s.Wall)
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	s := S([]byte{})
+	s.RunUntil(func(sys *Sys) bool {
+		return sys.Wall >= 400
+	})
+	if s.Wall != 400 {
+		t.Errorf("expected Wall=%d, got %d\n", 400, s.Wall)
+	}
+}
+
+func TestMemoryAccessTiming(t *testing.T) {
+	// LD A,(FF04h) reads DIV on its fourth machine cycle
+	for _, c := range []struct {
+		counter  uint16
+		expected uint8
+	}{
+		{0x00ec, 0x00},
+		{0x00f0, 0x01},
+	} {
+		s := S([]byte{0xfa, 0x04, 0xff})
+		s.timer.counter = c.counter
+		s.Step()
+		checkBr(t, s, A, c.expected)
+	}
+
+	// LD (FF04h),A resets DIV on its last machine cycle, so nothing gets
+	// ticked after it
+	s := S([]byte{0xea, 0x04, 0xff})
+	s.Step()
+	if s.timer.counter != 0 {
+		t.Errorf("expected counter=0, got %04Xh\n", s.timer.counter)
+	}
+
+	// JP a16 has an internal cycle after its reads
+	s = S([]byte{0xc3, 0x00, 0x02})
+	s.timer.counter = 0
+	s.Step()
+	if s.Wall != 16 || s.timer.counter != 16 {
+		t.Errorf("expected 16 cycles, got Wall=%d counter=%d\n", s.Wall, s.timer.counter)
+	}
 }
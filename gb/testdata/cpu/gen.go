@@ -0,0 +1,781 @@
+//go:build ignore
+// +build ignore
+
+/*
+ * Generates the single step tests in this directory, one file per opcode.
+ * The expected results come from a model of the CPU written from the
+ * documentation rather than from cpu.go, so the two can catch each other's
+ * mistakes. It decodes opcodes by their bit fields instead of a table, and
+ * runs against a sparse memory that starts out random wherever it's first
+ * touched. Run it from this directory with
+ *
+ *   go run gen.go
+ *
+ * HALT, STOP and the unused opcodes are left out. As a check on the model,
+ * every test's flags have to agree with the Z N H C column of the published
+ * opcode tables (https://gbdev.io/gb-opcodes/optables/), and it stops if one
+ * doesn't. The cycle counts are checked against blargg's instr_timing tables
+ * by TestInstrTiming, which cpu.go has to pass along with these.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+)
+
+// Random tests per opcode. A few get more, see casesFor.
+const defaultCases = 16
+
+const (
+	flagZ uint8 = 0x80
+	flagN uint8 = 0x40
+	flagH uint8 = 0x20
+	flagC uint8 = 0x10
+)
+
+type state struct {
+	PC  uint16     `json:"pc"`
+	SP  uint16     `json:"sp"`
+	A   uint8      `json:"a"`
+	B   uint8      `json:"b"`
+	C   uint8      `json:"c"`
+	D   uint8      `json:"d"`
+	E   uint8      `json:"e"`
+	F   uint8      `json:"f"`
+	H   uint8      `json:"h"`
+	L   uint8      `json:"l"`
+	IME uint8      `json:"ime"`
+	RAM [][2]int32 `json:"ram"`
+}
+
+type test struct {
+	Name    string        `json:"name"`
+	Initial state         `json:"initial"`
+	Final   state         `json:"final"`
+	Cycles  []interface{} `json:"cycles"`
+}
+
+type machine struct {
+	a, f, b, c, d, e, h, l uint8
+	sp, pc                 uint16
+	ime                    uint8
+
+	rnd *rand.Rand
+	mem map[uint16]uint8
+	// Every address we've touched, in the order we first touched it, and
+	// what it held before that
+	order   []uint16
+	initial map[uint16]uint8
+	cycles  []interface{}
+}
+
+func (m *machine) touch(addr uint16) {
+	if _, ok := m.mem[addr]; ok {
+		return
+	}
+	v := uint8(m.rnd.Intn(0x100))
+	m.mem[addr] = v
+	m.initial[addr] = v
+	m.order = append(m.order, addr)
+}
+
+// Put a known value in memory before we start.
+func (m *machine) poke(addr uint16, val uint8) {
+	m.touch(addr)
+	m.mem[addr] = val
+	m.initial[addr] = val
+}
+
+func (m *machine) read(addr uint16) uint8 {
+	m.touch(addr)
+	v := m.mem[addr]
+	m.cycles = append(m.cycles, []interface{}{addr, v, "r-m"})
+	return v
+}
+
+func (m *machine) write(addr uint16, val uint8) {
+	m.touch(addr)
+	m.mem[addr] = val
+	m.cycles = append(m.cycles, []interface{}{addr, val, "-wm"})
+}
+
+func (m *machine) internal() {
+	m.cycles = append(m.cycles, nil)
+}
+
+func (m *machine) fetch() uint8 {
+	v := m.read(m.pc)
+	m.pc++
+	return v
+}
+
+func (m *machine) fetch16() uint16 {
+	lo := m.fetch()
+	hi := m.fetch()
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func (m *machine) push(v uint16) {
+	m.sp--
+	m.write(m.sp, uint8(v>>8))
+	m.sp--
+	m.write(m.sp, uint8(v))
+}
+
+func (m *machine) pop() uint16 {
+	lo := m.read(m.sp)
+	m.sp++
+	hi := m.read(m.sp)
+	m.sp++
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func (m *machine) flag(f uint8) bool {
+	return m.f&f != 0
+}
+
+func (m *machine) setFlag(f uint8, on bool) {
+	if on {
+		m.f |= f
+	} else {
+		m.f &^= f
+	}
+}
+
+func (m *machine) setFlags(z, n, h, c bool) {
+	m.setFlag(flagZ, z)
+	m.setFlag(flagN, n)
+	m.setFlag(flagH, h)
+	m.setFlag(flagC, c)
+}
+
+func (m *machine) hl() uint16 {
+	return uint16(m.h)<<8 | uint16(m.l)
+}
+
+func (m *machine) setHL(v uint16) {
+	m.h, m.l = uint8(v>>8), uint8(v)
+}
+
+// The 8 bit operands in opcode order: B, C, D, E, H, L, (HL), A.
+func (m *machine) r(i uint8) uint8 {
+	switch i {
+	case 0:
+		return m.b
+	case 1:
+		return m.c
+	case 2:
+		return m.d
+	case 3:
+		return m.e
+	case 4:
+		return m.h
+	case 5:
+		return m.l
+	case 6:
+		return m.read(m.hl())
+	}
+	return m.a
+}
+
+func (m *machine) setR(i uint8, v uint8) {
+	switch i {
+	case 0:
+		m.b = v
+	case 1:
+		m.c = v
+	case 2:
+		m.d = v
+	case 3:
+		m.e = v
+	case 4:
+		m.h = v
+	case 5:
+		m.l = v
+	case 6:
+		m.write(m.hl(), v)
+	default:
+		m.a = v
+	}
+}
+
+// The 16 bit pairs in opcode order: BC, DE, HL and then SP, or AF for
+// PUSH and POP.
+func (m *machine) rp(i uint8, af bool) uint16 {
+	switch i {
+	case 0:
+		return uint16(m.b)<<8 | uint16(m.c)
+	case 1:
+		return uint16(m.d)<<8 | uint16(m.e)
+	case 2:
+		return m.hl()
+	}
+	if af {
+		return uint16(m.a)<<8 | uint16(m.f)
+	}
+	return m.sp
+}
+
+func (m *machine) setRP(i uint8, v uint16, af bool) {
+	switch i {
+	case 0:
+		m.b, m.c = uint8(v>>8), uint8(v)
+	case 1:
+		m.d, m.e = uint8(v>>8), uint8(v)
+	case 2:
+		m.setHL(v)
+	default:
+		if af {
+			m.a, m.f = uint8(v>>8), uint8(v)&0xf0
+		} else {
+			m.sp = v
+		}
+	}
+}
+
+// NZ, Z, NC, C
+func (m *machine) cond(i uint8) bool {
+	switch i {
+	case 0:
+		return !m.flag(flagZ)
+	case 1:
+		return m.flag(flagZ)
+	case 2:
+		return !m.flag(flagC)
+	}
+	return m.flag(flagC)
+}
+
+// ADD, ADC, SUB, SBC, AND, XOR, OR, CP
+func (m *machine) alu(op uint8, v uint8) {
+	a := m.a
+	carry := uint8(0)
+	if m.flag(flagC) {
+		carry = 1
+	}
+	var res uint8
+	switch op {
+	case 0, 1:
+		if op == 0 {
+			carry = 0
+		}
+		sum := uint(a) + uint(v) + uint(carry)
+		res = uint8(sum)
+		m.setFlags(res == 0, false, a&0x0f+v&0x0f+carry > 0x0f, sum > 0xff)
+	case 2, 3, 7:
+		if op != 3 {
+			carry = 0
+		}
+		res = a - v - carry
+		m.setFlags(res == 0, true, a&0x0f < v&0x0f+carry, uint(a) < uint(v)+uint(carry))
+	case 4:
+		res = a & v
+		m.setFlags(res == 0, false, true, false)
+	case 5:
+		res = a ^ v
+		m.setFlags(res == 0, false, false, false)
+	case 6:
+		res = a | v
+		m.setFlags(res == 0, false, false, false)
+	}
+	if op != 7 {
+		m.a = res
+	}
+}
+
+// RLC, RRC, RL, RR, SLA, SRA, SWAP, SRL. This sets C and returns the result.
+func (m *machine) shift(op uint8, v uint8) uint8 {
+	carryIn := uint8(0)
+	if m.flag(flagC) {
+		carryIn = 1
+	}
+	var res uint8
+	var carry bool
+	switch op {
+	case 0:
+		res, carry = v<<1|v>>7, v&0x80 != 0
+	case 1:
+		res, carry = v>>1|v<<7, v&0x01 != 0
+	case 2:
+		res, carry = v<<1|carryIn, v&0x80 != 0
+	case 3:
+		res, carry = v>>1|carryIn<<7, v&0x01 != 0
+	case 4:
+		res, carry = v<<1, v&0x80 != 0
+	case 5:
+		res, carry = v>>1|v&0x80, v&0x01 != 0
+	case 6:
+		res, carry = v<<4|v>>4, false
+	case 7:
+		res, carry = v>>1, v&0x01 != 0
+	}
+	m.setFlag(flagC, carry)
+	return res
+}
+
+func (m *machine) daa() {
+	a := m.a
+	carry := m.flag(flagC)
+	if !m.flag(flagN) {
+		if carry || a > 0x99 {
+			a += 0x60
+			carry = true
+		}
+		if m.flag(flagH) || a&0x0f > 0x09 {
+			a += 0x06
+		}
+	} else {
+		if carry {
+			a -= 0x60
+		}
+		if m.flag(flagH) {
+			a -= 0x06
+		}
+	}
+	m.a = a
+	m.setFlags(a == 0, m.flag(flagN), false, carry)
+}
+
+// SP plus a signed byte, with the flags set from the unsigned low byte sum
+// like ADD SP,e8 and LD HL,SP+e8 do.
+func (m *machine) spOffset(d uint8) uint16 {
+	sp := m.sp
+	m.setFlags(false, false, sp&0x0f+uint16(d&0x0f) > 0x0f, sp&0xff+uint16(d) > 0xff)
+	return sp + uint16(int8(d))
+}
+
+// Run the instruction at PC. Returns false for ones we don't generate.
+func (m *machine) step() bool {
+	op := m.fetch()
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch {
+			case y == 0: // NOP
+			case y == 1: // LD (nn),SP
+				addr := m.fetch16()
+				m.write(addr, uint8(m.sp))
+				m.write(addr+1, uint8(m.sp>>8))
+			case y == 2: // STOP
+				return false
+			default: // JR e8 and JR cc,e8
+				d := m.fetch()
+				if y == 3 || m.cond(y-4) {
+					m.internal()
+					m.pc += uint16(int8(d))
+				}
+			}
+		case 1:
+			if q == 0 { // LD rr,nn
+				m.setRP(p, m.fetch16(), false)
+			} else { // ADD HL,rr
+				m.internal()
+				hl, v := m.hl(), m.rp(p, false)
+				m.setFlag(flagN, false)
+				m.setFlag(flagH, hl&0x0fff+v&0x0fff > 0x0fff)
+				m.setFlag(flagC, uint(hl)+uint(v) > 0xffff)
+				m.setHL(hl + v)
+			}
+		case 2:
+			var addr uint16
+			switch p {
+			case 0, 1:
+				addr = m.rp(p, false)
+			case 2:
+				addr = m.hl()
+				m.setHL(addr + 1)
+			case 3:
+				addr = m.hl()
+				m.setHL(addr - 1)
+			}
+			if q == 0 {
+				m.write(addr, m.a)
+			} else {
+				m.a = m.read(addr)
+			}
+		case 3: // INC rr and DEC rr
+			m.internal()
+			v := m.rp(p, false)
+			if q == 0 {
+				v++
+			} else {
+				v--
+			}
+			m.setRP(p, v, false)
+		case 4: // INC r
+			v := m.r(y)
+			res := v + 1
+			m.setFlag(flagZ, res == 0)
+			m.setFlag(flagN, false)
+			m.setFlag(flagH, v&0x0f == 0x0f)
+			m.setR(y, res)
+		case 5: // DEC r
+			v := m.r(y)
+			res := v - 1
+			m.setFlag(flagZ, res == 0)
+			m.setFlag(flagN, true)
+			m.setFlag(flagH, v&0x0f == 0x00)
+			m.setR(y, res)
+		case 6: // LD r,n
+			m.setR(y, m.fetch())
+		case 7:
+			switch y {
+			case 0, 1, 2, 3: // RLCA, RRCA, RLA, RRA
+				m.a = m.shift(y, m.a)
+				m.setFlag(flagZ, false)
+				m.setFlag(flagN, false)
+				m.setFlag(flagH, false)
+			case 4:
+				m.daa()
+			case 5: // CPL
+				m.a = ^m.a
+				m.setFlag(flagN, true)
+				m.setFlag(flagH, true)
+			case 6: // SCF
+				m.setFlag(flagN, false)
+				m.setFlag(flagH, false)
+				m.setFlag(flagC, true)
+			case 7: // CCF
+				m.setFlag(flagN, false)
+				m.setFlag(flagH, false)
+				m.setFlag(flagC, !m.flag(flagC))
+			}
+		}
+	case 1:
+		if y == 6 && z == 6 { // HALT
+			return false
+		}
+		m.setR(y, m.r(z))
+	case 2:
+		m.alu(y, m.r(z))
+	case 3:
+		switch z {
+		case 0:
+			switch y {
+			case 0, 1, 2, 3: // RET cc
+				m.internal()
+				if m.cond(y) {
+					m.pc = m.pop()
+					m.internal()
+				}
+			case 4: // LDH (n),A
+				m.write(0xff00+uint16(m.fetch()), m.a)
+			case 5: // ADD SP,e8
+				d := m.fetch()
+				m.internal()
+				m.internal()
+				m.sp = m.spOffset(d)
+			case 6: // LDH A,(n)
+				m.a = m.read(0xff00 + uint16(m.fetch()))
+			case 7: // LD HL,SP+e8
+				d := m.fetch()
+				m.internal()
+				m.setHL(m.spOffset(d))
+			}
+		case 1:
+			if q == 0 { // POP rr
+				m.setRP(p, m.pop(), true)
+				break
+			}
+			switch p {
+			case 0, 1: // RET and RETI
+				m.pc = m.pop()
+				m.internal()
+				if p == 1 {
+					m.ime = 1
+				}
+			case 2: // JP HL
+				m.pc = m.hl()
+			case 3: // LD SP,HL
+				m.internal()
+				m.sp = m.hl()
+			}
+		case 2:
+			switch y {
+			case 0, 1, 2, 3: // JP cc,nn
+				addr := m.fetch16()
+				if m.cond(y) {
+					m.internal()
+					m.pc = addr
+				}
+			case 4: // LD (C),A
+				m.write(0xff00+uint16(m.c), m.a)
+			case 5: // LD (nn),A
+				m.write(m.fetch16(), m.a)
+			case 6: // LD A,(C)
+				m.a = m.read(0xff00 + uint16(m.c))
+			case 7: // LD A,(nn)
+				m.a = m.read(m.fetch16())
+			}
+		case 3:
+			switch y {
+			case 0: // JP nn
+				addr := m.fetch16()
+				m.internal()
+				m.pc = addr
+			case 1:
+				m.stepCB()
+			case 6: // DI
+				m.ime = 0
+			case 7: // EI, which doesn't take effect until after the next
+				// instruction
+			default:
+				return false
+			}
+		case 4: // CALL cc,nn
+			if y > 3 {
+				return false
+			}
+			addr := m.fetch16()
+			if m.cond(y) {
+				m.internal()
+				m.push(m.pc)
+				m.pc = addr
+			}
+		case 5:
+			if q == 0 { // PUSH rr
+				m.internal()
+				m.push(m.rp(p, true))
+			} else if p == 0 { // CALL nn
+				addr := m.fetch16()
+				m.internal()
+				m.push(m.pc)
+				m.pc = addr
+			} else {
+				return false
+			}
+		case 6: // ALU A,n
+			m.alu(y, m.fetch())
+		case 7: // RST
+			m.internal()
+			m.push(m.pc)
+			m.pc = uint16(y) * 8
+		}
+	}
+	return true
+}
+
+func (m *machine) stepCB() {
+	op := m.fetch()
+	x, y, z := op>>6, op>>3&7, op&7
+	v := m.r(z)
+	switch x {
+	case 0: // Rotates and shifts
+		res := m.shift(y, v)
+		m.setFlag(flagZ, res == 0)
+		m.setFlag(flagN, false)
+		m.setFlag(flagH, false)
+		m.setR(z, res)
+	case 1: // BIT
+		m.setFlag(flagZ, v&(1<<y) == 0)
+		m.setFlag(flagN, false)
+		m.setFlag(flagH, true)
+	case 2: // RES
+		m.setR(z, v&^(1<<y))
+	case 3: // SET
+		m.setR(z, v|1<<y)
+	}
+}
+
+func (m *machine) registers() state {
+	return state{
+		PC: m.pc, SP: m.sp,
+		A: m.a, B: m.b, C: m.c, D: m.d, E: m.e, F: m.f, H: m.h, L: m.l,
+		IME: m.ime,
+	}
+}
+
+/*
+ * How an opcode affects Z, N, H and C, as the opcode tables give it: - for
+ * left alone, 0 or 1 for always cleared or set, and the flag's letter for
+ * depends on the result.
+ */
+func flagEffects(code []uint8) string {
+	op := code[len(code)-1]
+	if len(code) > 1 {
+		switch {
+		case op >= 0x30 && op < 0x38: // SWAP
+			return "Z000"
+		case op < 0x40: // Rotates and shifts
+			return "Z00C"
+		case op < 0x80: // BIT
+			return "Z01-"
+		}
+		return "----" // RES and SET
+	}
+	switch {
+	case op < 0x40 && op&0x07 == 0x04: // INC r
+		return "Z0H-"
+	case op < 0x40 && op&0x07 == 0x05: // DEC r
+		return "Z1H-"
+	case op < 0x40 && op&0x0f == 0x09: // ADD HL,rr
+		return "-0HC"
+	case op >= 0x80 && op < 0xc0:
+		return [8]string{"Z0HC", "Z0HC", "Z1HC", "Z1HC", "Z010", "Z000", "Z000", "Z1HC"}[op>>3&7]
+	case op >= 0xc0 && op&0x07 == 0x06: // ALU A,d8
+		return [8]string{"Z0HC", "Z0HC", "Z1HC", "Z1HC", "Z010", "Z000", "Z000", "Z1HC"}[op>>3&7]
+	}
+	switch op {
+	case 0x07, 0x0f, 0x17, 0x1f: // RLCA, RRCA, RLA, RRA
+		return "000C"
+	case 0x27: // DAA
+		return "Z-0C"
+	case 0x2f: // CPL
+		return "-11-"
+	case 0x37: // SCF
+		return "-001"
+	case 0x3f: // CCF
+		return "-00C"
+	case 0xe8, 0xf8: // ADD SP,e8 and LD HL,SP+e8
+		return "00HC"
+	case 0xf1: // POP AF
+		return "ZNHC"
+	}
+	return "----"
+}
+
+// Check a test's flags against flagEffects.
+func checkFlags(code []uint8, before uint8, after uint8) error {
+	effects := flagEffects(code)
+	for i, f := range []uint8{flagZ, flagN, flagH, flagC} {
+		var ok bool
+		switch effects[i] {
+		case '-':
+			ok = after&f == before&f
+		case '0':
+			ok = after&f == 0
+		case '1':
+			ok = after&f != 0
+		default:
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("% x changed flags %02x to %02x, but the tables say %s", code, before, after, effects)
+		}
+	}
+	return nil
+}
+
+/*
+ * Make a random test for an opcode (CBh followed by the second byte for
+ * prefixed ones). set can fix up the registers before it runs.
+ */
+func makeTest(rnd *rand.Rand, name string, code []uint8, set func(m *machine)) (test, bool, error) {
+	m := &machine{
+		a: uint8(rnd.Intn(0x100)), f: uint8(rnd.Intn(0x100)) & 0xf0,
+		b: uint8(rnd.Intn(0x100)), c: uint8(rnd.Intn(0x100)),
+		d: uint8(rnd.Intn(0x100)), e: uint8(rnd.Intn(0x100)),
+		h: uint8(rnd.Intn(0x100)), l: uint8(rnd.Intn(0x100)),
+		sp: uint16(rnd.Intn(0x10000)), pc: uint16(rnd.Intn(0x10000)),
+		ime:     uint8(rnd.Intn(2)),
+		rnd:     rnd,
+		mem:     map[uint16]uint8{},
+		initial: map[uint16]uint8{},
+	}
+	if set != nil {
+		set(m)
+	}
+	for i, b := range code {
+		m.poke(m.pc+uint16(i), b)
+	}
+	t := test{Name: name, Initial: m.registers()}
+	if !m.step() {
+		return t, false, nil
+	}
+	if err := checkFlags(code, t.Initial.F, m.f); err != nil {
+		return t, false, err
+	}
+	t.Final = m.registers()
+	t.Cycles = m.cycles
+	for _, addr := range m.order {
+		t.Initial.RAM = append(t.Initial.RAM, [2]int32{int32(addr), int32(m.initial[addr])})
+		t.Final.RAM = append(t.Final.RAM, [2]int32{int32(addr), int32(m.mem[addr])})
+	}
+	return t, true, nil
+}
+
+/*
+ * How many tests to make for an opcode, and how to set up each one. The
+ * opcodes with the most corner cases get one test for every interesting
+ * input rather than random ones.
+ */
+func casesFor(code []uint8) (int, func(i int, m *machine)) {
+	if len(code) > 1 {
+		return defaultCases, nil
+	}
+	switch code[0] {
+	case 0x27: // DAA, every A with every combination of N, H and C
+		return 0x800, func(i int, m *machine) {
+			m.a = uint8(i)
+			m.f = m.f&flagZ | uint8(i>>8)<<4
+		}
+	case 0xe8, 0xf8: // ADD SP,e8 and LD HL,SP+e8, every offset
+		return 0x100, func(i int, m *machine) {
+			m.poke(m.pc+1, uint8(i))
+		}
+	case 0xc6, 0xce, 0xd6, 0xde, 0xe6, 0xee, 0xf6, 0xfe: // ALU A,d8, every operand
+		return 0x100, func(i int, m *machine) {
+			m.poke(m.pc+1, uint8(i))
+		}
+	}
+	return defaultCases, nil
+}
+
+// Write name.json, unless it's an opcode we don't generate tests for.
+func generate(name string, code []uint8) error {
+	n, set := casesFor(code)
+	rnd := rand.New(rand.NewSource(int64(code[0])<<8 | int64(code[len(code)-1])))
+	buf := &bytes.Buffer{}
+	buf.WriteString("[\n")
+	for i := 0; i < n; i++ {
+		i := i
+		var setup func(m *machine)
+		if set != nil {
+			setup = func(m *machine) { set(i, m) }
+		}
+		t, ok, err := makeTest(rnd, fmt.Sprintf("%s %04x", name, i), code, setup)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		line, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		if i != n-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]\n")
+	return ioutil.WriteFile(name+".json", buf.Bytes(), 0644)
+}
+
+func main() {
+	for op := 0; op < 0x100; op++ {
+		if op == 0xcb {
+			continue
+		}
+		name := fmt.Sprintf("%02x", op)
+		if err := generate(name, []uint8{uint8(op)}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for op := 0; op < 0x100; op++ {
+		name := fmt.Sprintf("cb%02x", op)
+		if err := generate(name, []uint8{0xcb, uint8(op)}); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
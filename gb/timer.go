@@ -5,94 +5,136 @@ import (
 	"fmt"
 )
 
-type Timer struct {
-	divReg  *MemRegister
-	timaReg *MemRegister
-	tmaReg  *MemRegister
-	tacReg  *MemRegister
-
-	devs []BusDev
-}
-
 const divRegAddr uint16 = 0xff04
-const divFreq uint = 16384
+const timaRegAddr uint16 = 0xff05
+const tmaRegAddr uint16 = 0xff06
+const tacRegAddr uint16 = 0xff07
+
+// The bit of the system counter that clocks TIMA for each TAC speed.
+var tacCounterBit [4]uint16 = [4]uint16{
+	0: 1 << 9, // 4096Hz
+	1: 1 << 3, // 262144Hz
+	2: 1 << 5, // 65536Hz
+	3: 1 << 7, // 16384Hz
+}
 
-var tacValToFreq map[uint8]uint = map[uint8]uint{
-	0: 4096,
-	1: 262144,
-	2: 65536,
-	3: 16384,
+/*
+ * The timer is driven by a 16 bit counter that goes up every clock cycle, and
+ * DIV is just its top 8 bits. TIMA goes up whenever the counter bit picked by
+ * TAC, ANDed with the TAC enable bit, goes from 1 to 0. Doing it this way
+ * rather than counting cycles gets all the quirks for free: resetting DIV
+ * resets the prescaler too (and can clock TIMA if the bit was high), and so
+ * can changing TAC.
+ */
+type Timer struct {
+	counter uint16
+	tima    uint8
+	tma     uint8
+	tac     uint8
+
+	// TIMA overflowed last cycle and reads as 00h until it's reloaded from
+	// TMA on this one.
+	overflowed bool
+	// TIMA was reloaded this cycle, so writes to TIMA are ignored and writes
+	// to TMA go straight through to it.
+	reloaded bool
 }
 
 func NewTimer() *Timer {
-	divReg := NewMemRegister(divRegAddr)
-	timaReg := NewMemRegister(0xff05)
-	tmaReg := NewMemRegister(0xff06)
-	tacReg := NewMemRegister(0xff07)
-
-	devs := []BusDev{divReg, timaReg, tmaReg, tacReg}
+	return &Timer{}
+}
 
-	return &Timer{divReg, timaReg, tmaReg, tacReg, devs}
+// Where the boot ROM leaves the counter when it jumps to the cartridge.
+func (t *Timer) SetPostBootloaderState() {
+	t.counter = 0xabcc
 }
 
 func (t *Timer) State() string {
 	o := bytes.Buffer{}
 	o.WriteString(fmt.Sprintf("Timer:\n"))
-	o.WriteString(fmt.Sprintf("   DIV: %02Xh\n", t.divReg.val()))
-	o.WriteString(fmt.Sprintf("  TIMA: %02Xh\n", t.timaReg.val()))
-	o.WriteString(fmt.Sprintf("   TMA: %02Xh\n", t.tmaReg.val()))
-	o.WriteString(fmt.Sprintf("   TAC: %02Xh\n", t.tacReg.val()))
+	o.WriteString(fmt.Sprintf("   DIV: %02Xh (%04Xh)\n", t.div(), t.counter))
+	o.WriteString(fmt.Sprintf("  TIMA: %02Xh\n", t.tima))
+	o.WriteString(fmt.Sprintf("   TMA: %02Xh\n", t.tma))
+	o.WriteString(fmt.Sprintf("   TAC: %02Xh\n", t.tac))
 
 	return o.String()
 }
 
-func (t *Timer) getHandler(addr uint16) BusDev {
-	for _, bd := range t.devs {
-		if bd.Asserts(addr) {
-			return bd
+func (t *Timer) saveState(w *stateWriter) {
+	w.write(t.counter, t.tima, t.tma, t.tac, t.overflowed, t.reloaded)
+}
+
+func (t *Timer) loadState(r *stateReader) {
+	r.read(&t.counter, &t.tima, &t.tma, &t.tac, &t.overflowed, &t.reloaded)
+}
+
+func (t *Timer) div() uint8 {
+	return uint8(t.counter >> 8)
+}
+
+// The input to the falling edge detector that clocks TIMA.
+func (t *Timer) signal() bool {
+	return t.tac&0x04 != 0 && t.counter&tacCounterBit[t.tac&0x03] != 0
+}
+
+// Make a change to the counter or TAC, clocking TIMA if that makes the
+// signal fall.
+func (t *Timer) update(f func()) {
+	before := t.signal()
+	f()
+	if before && !t.signal() {
+		t.tima++
+		if t.tima == 0 {
+			t.overflowed = true
 		}
 	}
-	return nil
 }
 
 func (t *Timer) Step(sys *Sys) {
-	// Handle div register first
-	if sys.FreqStep(divFreq) {
-		t.divReg.set(t.divReg.val() + 1)
-	}
-
-	// Now handle timer
-	tac := t.tacReg.val()
-	// Timer is disabled, so don't do anything more
-	if tac&0x04 == 0 {
-		return
-	}
-	if sys.FreqStep(tacValToFreq[tac&0x03]) {
-		if t.timaReg.val() == 0xff {
-			// Overflow!
-			t.timaReg.set(t.tmaReg.val())
-			sys.RaiseInterrupt(TimerInterrupt)
-		} else {
-			// Not overflow!
-			t.timaReg.set(t.timaReg.val() + 1)
-		}
+	t.reloaded = false
+	if t.overflowed {
+		t.overflowed = false
+		t.reloaded = true
+		t.tima = t.tma
+		sys.RaiseInterrupt(TimerInterrupt)
 	}
+	t.update(func() { t.counter += 4 })
 }
 
 func (t *Timer) R(addr uint16) uint8 {
-	return t.getHandler(addr).R(addr)
+	switch addr {
+	case divRegAddr:
+		return t.div()
+	case timaRegAddr:
+		return t.tima
+	case tmaRegAddr:
+		return t.tma
+	}
+	return t.tac | 0xf8
 }
 
 func (t *Timer) W(addr uint16, val uint8) {
-	// Have a special case for any kind of a write to divReg, which should set
-	// it to 0
-	if addr == divRegAddr {
-		t.divReg.set(0)
-		return
+	switch addr {
+	case divRegAddr:
+		// Any write resets the whole counter
+		t.update(func() { t.counter = 0 })
+	case timaRegAddr:
+		if t.reloaded {
+			return
+		}
+		// Writing during the overflow cycle cancels the reload
+		t.tima = val
+		t.overflowed = false
+	case tmaRegAddr:
+		t.tma = val
+		if t.reloaded {
+			t.tima = val
+		}
+	case tacRegAddr:
+		t.update(func() { t.tac = val & 0x07 })
 	}
-	t.getHandler(addr).W(addr, val)
 }
 
 func (t *Timer) Asserts(addr uint16) bool {
-	return t.getHandler(addr) != nil
+	return addr >= divRegAddr && addr <= tacRegAddr
 }
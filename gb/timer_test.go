@@ -0,0 +1,119 @@
+package gb
+
+import "testing"
+
+func timerSys() *Sys {
+	s := S([]byte{})
+	s.timer.counter = 0
+	return s
+}
+
+func stepTimer(s *Sys, cycles int) {
+	for i := 0; i < cycles; i += 4 {
+		s.timer.Step(s)
+	}
+}
+
+func checkTIMA(t *testing.T, s *Sys, expected uint8) {
+	if got := s.Rb(timaRegAddr); got != expected {
+		t.Errorf("expected TIMA=%02Xh, got %02Xh\n", expected, got)
+	}
+}
+
+func TestTimerDIV(t *testing.T) {
+	s := timerSys()
+	stepTimer(s, 256*3)
+	if got := s.Rb(divRegAddr); got != 3 {
+		t.Errorf("expected DIV=3, got %d\n", got)
+	}
+	s.Wb(divRegAddr, 0x55)
+	if got := s.Rb(divRegAddr); got != 0 {
+		t.Errorf("expected DIV=0 after write, got %d\n", got)
+	}
+}
+
+func TestTimerTIMA(t *testing.T) {
+	s := timerSys()
+	s.Wb(tacRegAddr, 0x05)
+	stepTimer(s, 16*10)
+	checkTIMA(t, s, 10)
+	if got := s.Rb(tacRegAddr); got != 0xfd {
+		t.Errorf("expected TAC=FDh, got %02Xh\n", got)
+	}
+}
+
+func TestTimerDIVResetsPrescaler(t *testing.T) {
+	s := timerSys()
+	s.Wb(tacRegAddr, 0x04)
+	// Keep resetting DIV before bit 9 ever gets set
+	for i := 0; i < 10; i++ {
+		stepTimer(s, 500)
+		s.Wb(divRegAddr, 0)
+	}
+	checkTIMA(t, s, 0)
+
+	// Resetting while bit 9 is set is a falling edge
+	stepTimer(s, 512)
+	s.Wb(divRegAddr, 0)
+	checkTIMA(t, s, 1)
+}
+
+func TestTimerTACGlitch(t *testing.T) {
+	s := timerSys()
+	s.Wb(tacRegAddr, 0x05)
+	stepTimer(s, 8)
+	// Disabling the timer while the selected bit is high clocks TIMA
+	s.Wb(tacRegAddr, 0x01)
+	checkTIMA(t, s, 1)
+	// And so does switching to a bit that's low
+	s.Wb(tacRegAddr, 0x05)
+	s.Wb(tacRegAddr, 0x04)
+	checkTIMA(t, s, 2)
+}
+
+func TestTimerOverflowDelay(t *testing.T) {
+	s := timerSys()
+	s.Wb(tmaRegAddr, 0x42)
+	s.Wb(timaRegAddr, 0xff)
+	s.Wb(tacRegAddr, 0x05)
+	s.ifReg.set(0)
+	stepTimer(s, 16)
+	// TIMA reads 0 for a cycle before the reload and interrupt
+	checkTIMA(t, s, 0x00)
+	if s.ifReg.val()&(1<<TimerInterrupt) != 0 {
+		t.Errorf("expected no timer interrupt yet\n")
+	}
+	stepTimer(s, 4)
+	checkTIMA(t, s, 0x42)
+	if s.ifReg.val()&(1<<TimerInterrupt) == 0 {
+		t.Errorf("expected timer interrupt\n")
+	}
+}
+
+func TestTimerOverflowWrites(t *testing.T) {
+	// Writing TIMA in the overflow cycle cancels the reload
+	s := timerSys()
+	s.Wb(tmaRegAddr, 0x42)
+	s.Wb(timaRegAddr, 0xff)
+	s.Wb(tacRegAddr, 0x05)
+	s.ifReg.set(0)
+	stepTimer(s, 16)
+	s.Wb(timaRegAddr, 0x10)
+	stepTimer(s, 4)
+	checkTIMA(t, s, 0x10)
+	if s.ifReg.val()&(1<<TimerInterrupt) != 0 {
+		t.Errorf("expected the interrupt to be cancelled\n")
+	}
+
+	// Writing TIMA in the reload cycle is ignored, but writing TMA goes
+	// straight through
+	s = timerSys()
+	s.Wb(tmaRegAddr, 0x42)
+	s.Wb(timaRegAddr, 0xff)
+	s.Wb(tacRegAddr, 0x05)
+	stepTimer(s, 20)
+	s.Wb(timaRegAddr, 0x10)
+	checkTIMA(t, s, 0x42)
+	s.Wb(tmaRegAddr, 0x24)
+	checkTIMA(t, s, 0x24)
+}
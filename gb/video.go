@@ -3,11 +3,8 @@ package gb
 import (
 	"bytes"
 	"fmt"
-	"sort"
 )
 
-const bufferSizeX uint = 256
-const bufferSizeY uint = 256
 const LCDSizeX uint = 160
 const LCDSizeY uint = 144
 
@@ -29,11 +26,23 @@ type Pixel uint8
  */
 const hCycles int = 456
 const totalCycles int = 70224
-const vblankCycles int = 65664
+const vblankLine int = 144
+const totalLines int = 154
 
+// Mode 2 (OAM scan) always takes 80 cycles. Mode 3 (drawing) takes at least
+// 172 but gets longer with scrolling, the window and sprites, and mode 0
+// (HBlank) is whatever's left of the line.
 const mode2Length int = 80
-const mode3Length int = 172
-const mode0Length int = 204
+
+// The modes as they show up in the bottom two bits of STAT.
+const (
+	modeHBlank uint8 = 0
+	modeVBlank uint8 = 1
+	modeOAM    uint8 = 2
+	modeDraw   uint8 = 3
+)
+
+const maxLineSprites = 10
 
 type Video struct {
 	swapper  VideoSwapper
@@ -57,14 +66,70 @@ type Video struct {
 	wy   *MemRegister       // FF4ah
 	wx   *MemRegister       // FF4bh
 
-	doDma  bool
-	dmaSrc uint16
-
-	currentCycle int
+	// OAM DMA copies a byte a machine cycle, starting a cycle after FF46 is
+	// written. Writing it again mid-transfer starts over, but the old
+	// transfer carries on until the new one actually starts.
+	dmaActive   bool
+	dmaSrc      uint16
+	dmaIndex    uint16
+	dmaStarting bool
+	dmaStartSrc uint16
+	// Set on cycles where a byte was copied, the CPU can only get at HRAM
+	// and the IO registers while it is
+	dmaBlocking bool
+
+	// Where we are in the frame
+	line uint8
+	dot  uint16
+	mode uint8
+
+	// Set when we enter VBlank so Sys knows a frame just finished
+	frameDone bool
+	// The STAT interrupt line, which is all the enabled STAT sources ORed
+	// together. The interrupt only fires when it goes high.
+	statLine bool
+
+	// The next pixel on the line to be drawn
+	lx uint8
+	// Pixels left to throw away for SCX's fine scroll
+	discard uint8
+	// Whether we've switched over to fetching the window on this line
+	windowActive bool
+	// The window has its own line counter, which only goes up on lines it
+	// was actually drawn on
+	windowLine uint8
+	// Set once LY has matched WY this frame, the window can't start before
+	windowYHit bool
+	// WX=166 makes the window take up all of the next line
+	windowNextLine bool
+
+	bgFIFO  pixelFIFO
+	objFIFO pixelFIFO
+
+	// The background fetcher. It takes two cycles each to read the tile
+	// number and the two bytes of tile data, then pushes a whole tile row
+	// into bgFIFO as soon as it's empty.
+	fetchDot uint8
+	fetchX   uint8
+	tileNum  uint8
+	tileLo   uint8
+	tileHi   uint8
+	// The first fetch on each line gets thrown away
+	firstFetch bool
+
+	// The sprites the OAM scan found for this line, as OAM indexes
+	lineSprites  [maxLineSprites]uint8
+	nLineSprites uint8
+	// Which of lineSprites have been fetched so far, as a bitmask
+	spritesFetched uint16
+	// Set while we're stalled fetching a sprite
+	objFetching bool
+	objDot      uint8
+	objSlot     uint8
 }
 
 const oamAddr uint16 = 0xfe00
-const oamSize uint16 = 40
+const oamSize uint16 = 0xa0
 
 type SwapFunc func(pixels [LCDSizeX * LCDSizeY]Pixel)
 
@@ -119,23 +184,10 @@ type LCDStatusRegister struct {
 }
 
 func (l *LCDStatusRegister) val() uint8 {
-	// The actual timings seem to suggest that at the beginning of a line
-	// we'll be in mode 2 for 80 cycles, followed by mode 3 for 172 cycles,
-	// followed by mode 0 for 204 cycles, which adds up nicely to 456.
-	flags := uint8(0)
-	if l.video.currentCycle >= vblankCycles {
-		flags = 1
-	}
-	hcycleNum := l.video.currentCycle % hCycles
-	if hcycleNum < mode2Length {
-		flags = 2
-	} else if hcycleNum < mode2Length+mode3Length {
-		flags = 3
-	}
-	if l.video.lyc.val() == l.video.regLY() {
+	flags := l.video.mode
+	if l.video.lycMatch() {
 		flags |= 0x4
 	}
-	// If none of these cases are true we're in mode 0, which lasts 204 cycles
 
 	return l.v | flags
 }
@@ -175,46 +227,107 @@ func (v *Video) Asserts(addr uint16) bool {
 }
 
 func (v *Video) Step(sys *Sys) {
-	if v.doDma {
-		v.doDma = false
-		b := sys.ReadBytes(v.dmaSrc, oamSize)
-		sys.WriteBytes(b, oamAddr)
-	}
+	v.stepDMA(sys)
 	lcdc := v.lcdc.val()
 	if lcdc&0x80 == 0 {
 		// We're disabled, so make sure we aren't running!
-		v.currentCycle = 0
+		v.line = 0
+		v.dot = 0
+		v.mode = modeHBlank
+		v.statLine = false
 		return
 	}
-	stat := v.stat.val()
-	if v.currentCycle == vblankCycles {
-		sys.RaiseInterrupt(VBlankInterrupt)
-		// Apparently we can have LCDStatus fire for vsync too
-		if stat&(1<<4) != 0 {
-			sys.RaiseInterrupt(LCDStatInterrupt)
+	for i := 0; i < 4; i++ {
+		v.stepDot(sys)
+	}
+}
+
+// Run the PPU for a single cycle.
+func (v *Video) stepDot(sys *Sys) {
+	if v.dot == 0 {
+		v.startLine(sys)
+	}
+	switch v.mode {
+	case modeOAM:
+		if int(v.dot) == mode2Length-1 {
+			v.scanOAM()
+			v.startDrawing()
 		}
-		// We're done drawing lines, so send send the output up to
-		// gl so it can munge it into a gl texture
-		if v.swapper != nil {
-			v.swapper.VideoSwap(v.buf)
+	case modeDraw:
+		v.drawDot()
+	}
+	v.dot++
+	if int(v.dot) == hCycles {
+		v.dot = 0
+		v.line++
+		if int(v.line) == totalLines {
+			v.line = 0
 		}
-		//fmt.Printf("wall: %d\n", sys.Wall)
 	}
-	// Interrupt for mode 2 OAM (which occurs at the beginning of a new line)
-	if v.currentCycle%hCycles == 0 && stat&(1<<5) != 0 && v.currentCycle < vblankCycles {
+	v.updateSTATLine(sys)
+}
+
+func (v *Video) updateSTATLine(sys *Sys) {
+	stat := v.stat.v
+	line := (stat&(1<<3) != 0 && v.mode == modeHBlank) ||
+		(stat&(1<<4) != 0 && v.mode == modeVBlank) ||
+		(stat&(1<<5) != 0 && v.mode == modeOAM) ||
+		(stat&(1<<6) != 0 && v.lycMatch())
+	if line && !v.statLine {
 		sys.RaiseInterrupt(LCDStatInterrupt)
 	}
-	// Interrupt for LCY==LY
-	if v.currentCycle%hCycles == 0 && stat&(1<<6) != 0 && v.regLY() == v.lyc.val() {
-		sys.RaiseInterrupt(LCDStatInterrupt)
+	v.statLine = line
+}
+
+/*
+ * The value LY=LYC is being checked against right now, if any. LY changes at
+ * the start of each line, and the comparison reads false for the first
+ * machine cycle while it catches up. Line 153 is odd: LY only reads 153 for
+ * a machine cycle before going to 0 early, and the comparison follows along
+ * a cycle behind.
+ */
+func (v *Video) lyCompare() (uint8, bool) {
+	if int(v.line) == totalLines-1 {
+		switch {
+		case v.dot < 4:
+			return 0, false
+		case v.dot < 8:
+			return v.line, true
+		case v.dot < 12:
+			return 0, false
+		}
+		return 0, true
 	}
-	if v.currentCycle%hCycles == mode2Length && v.currentCycle < vblankCycles {
-		// We've reached the end of mode 2, so transition to mode 3 and
-		// zap a line in place!
-		v.drawLine(sys)
+	if v.line != 0 && v.dot < 4 {
+		return 0, false
+	}
+	return v.line, true
+}
+
+func (v *Video) lycMatch() bool {
+	ly, ok := v.lyCompare()
+	return ok && ly == v.lyc.val()
+}
+
+func (v *Video) startLine(sys *Sys) {
+	if int(v.line) == vblankLine {
+		v.mode = modeVBlank
+		v.windowLine = 0
+		v.windowYHit = false
+		v.windowNextLine = false
+		sys.RaiseInterrupt(VBlankInterrupt)
+		// We're done drawing lines, so send send the output up to
+		// gl so it can munge it into a gl texture
+		if v.swapper != nil {
+			v.swapper.VideoSwap(v.buf)
+		}
+		v.frameDone = true
+	} else if int(v.line) < vblankLine {
+		v.mode = modeOAM
+		if v.line == v.wy.val() {
+			v.windowYHit = true
+		}
 	}
-	v.currentCycle += 4
-	v.currentCycle %= totalCycles
 }
 
 func (v *Video) State(sys *Sys) string {
@@ -222,323 +335,456 @@ func (v *Video) State(sys *Sys) string {
 	o.WriteString(fmt.Sprintf("Registers:\n"))
 	o.WriteString(fmt.Sprintf("  LY: %02Xh\n", sys.Rb(0xff44)))
 	o.WriteString(fmt.Sprintf("Values:\n"))
-	o.WriteString(fmt.Sprintf("  currentCycle: %v\n", v.currentCycle))
+	o.WriteString(fmt.Sprintf("  line: %v dot: %v mode: %v\n", v.line, v.dot, v.mode))
+	o.WriteString(fmt.Sprintf("  lx: %v\n", v.lx))
 
 	return o.String()
 }
 
+func (v *Video) saveState(w *stateWriter) {
+	w.blob(v.videoRAM.data)
+	w.blob(v.oam.data)
+	w.write(v.lcdc.val(), v.stat.v, v.scy.val(), v.scx.val(), v.lyc.val())
+	w.write(v.bgp.val(), v.obp0.val(), v.obp1.val(), v.wy.val(), v.wx.val())
+	w.write(v.dmaActive, v.dmaSrc, v.dmaIndex, v.dmaStarting, v.dmaStartSrc, v.dmaBlocking)
+	w.write(v.statLine)
+	w.write(v.line, v.dot, v.mode, v.lx, v.discard, v.windowActive)
+	w.write(v.windowLine, v.windowYHit, v.windowNextLine)
+	w.write(v.bgFIFO.pix, v.bgFIFO.head, v.bgFIFO.n)
+	w.write(v.objFIFO.pix, v.objFIFO.head, v.objFIFO.n)
+	w.write(v.fetchDot, v.fetchX, v.tileNum, v.tileLo, v.tileHi, v.firstFetch)
+	w.write(v.lineSprites, v.nLineSprites, v.spritesFetched)
+	w.write(v.objFetching, v.objDot, v.objSlot)
+	w.write(v.buf[:])
+}
+
+func (v *Video) loadState(r *stateReader) {
+	r.blobInto(v.videoRAM.data, "video RAM")
+	r.blobInto(v.oam.data, "OAM")
+	r.read(v.lcdc.data, &v.stat.v, v.scy.data, v.scx.data, v.lyc.data)
+	r.read(v.bgp.data, v.obp0.data, v.obp1.data, v.wy.data, v.wx.data)
+	r.read(&v.dmaActive, &v.dmaSrc, &v.dmaIndex, &v.dmaStarting, &v.dmaStartSrc, &v.dmaBlocking)
+	r.read(&v.statLine)
+	r.read(&v.line, &v.dot, &v.mode, &v.lx, &v.discard, &v.windowActive)
+	r.read(&v.windowLine, &v.windowYHit, &v.windowNextLine)
+	r.read(&v.bgFIFO.pix, &v.bgFIFO.head, &v.bgFIFO.n)
+	r.read(&v.objFIFO.pix, &v.objFIFO.head, &v.objFIFO.n)
+	r.read(&v.fetchDot, &v.fetchX, &v.tileNum, &v.tileLo, &v.tileHi, &v.firstFetch)
+	r.read(&v.lineSprites, &v.nLineSprites, &v.spritesFetched)
+	r.read(&v.objFetching, &v.objDot, &v.objSlot)
+	r.read(v.buf[:])
+}
+
 func (v *Video) regLY() uint8 {
-	return uint8(v.currentCycle / hCycles)
+	if int(v.line) == totalLines-1 && v.dot >= 4 {
+		return 0
+	}
+	return v.line
 }
 
 func (v *Video) dmaW(val uint8) {
-	v.doDma = true
-	v.dmaSrc = uint16(val) * 0x100
+	v.dmaStarting = true
+	v.dmaStartSrc = uint16(val) * 0x100
+	// Everything from E000h up reads from work RAM
+	if v.dmaStartSrc >= 0xe000 {
+		v.dmaStartSrc -= 0x2000
+	}
 }
 
-const nOAMblocks uint = 40
-const OAMblockSize uint = 4
+func (v *Video) stepDMA(sys *Sys) {
+	v.dmaBlocking = false
+	if v.dmaActive {
+		if v.dmaIndex < oamSize {
+			v.oam.data[v.dmaIndex] = sys.RbLog(v.dmaSrc+v.dmaIndex, false)
+			v.dmaIndex++
+			v.dmaBlocking = true
+		} else {
+			v.dmaActive = false
+		}
+	}
+	if v.dmaStarting {
+		v.dmaStarting = false
+		v.dmaActive = true
+		v.dmaSrc = v.dmaStartSrc
+		v.dmaIndex = 0
+	}
+}
 
-type OAMblock struct {
-	y       uint8
-	x       uint8
-	pattern uint8
-	flags   uint8
-	index   uint
+// Whether a DMA in progress keeps the CPU from accessing addr.
+func (v *Video) dmaBlocks(addr uint16) bool {
+	return v.dmaBlocking && addr < 0xff00
 }
 
-type OAMblocksByReversePriority []OAMblock
+/*
+ * Pixels waiting to be drawn. Each one is the colour number from the tile
+ * data plus, for sprites, which palette to use and whether it goes behind the
+ * background.
+ */
+type fifoPixel uint8
 
-func (a OAMblocksByReversePriority) Len() int      { return len(a) }
-func (a OAMblocksByReversePriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a OAMblocksByReversePriority) Less(i, j int) bool {
-	if a[i].x == a[j].x {
-		return a[i].index > a[j].index
-	}
-	return a[i].x > a[j].x
-}
+const (
+	fifoPixelColor    fifoPixel = 0x03
+	fifoPixelOBP1     fifoPixel = 0x10
+	fifoPixelBehindBG fifoPixel = 0x80
+)
 
-func (o *OAMblock) priority() bool {
-	return o.flags&0x80 != 0
+const (
+	pixelFIFOSize      uint8 = 16
+	fifoPixelsPerFetch uint8 = 8
+	// The fetcher reads the second byte of tile data on this cycle, and
+	// then sits on the next one until it can push.
+	fetcherLastFetchDot uint8 = 5
+	fetcherPushDot      uint8 = 6
+	spriteFetchDots     uint8 = 6
+)
+
+func (p fifoPixel) color() Pixel {
+	return Pixel(p & fifoPixelColor)
 }
 
-func (o *OAMblock) yFlip() bool {
-	return o.flags&0x40 != 0
+type pixelFIFO struct {
+	pix  [pixelFIFOSize]fifoPixel
+	head uint8
+	n    uint8
 }
 
-func (o *OAMblock) xFlip() bool {
-	return o.flags&0x20 != 0
+func (f *pixelFIFO) clear() {
+	f.head = 0
+	f.n = 0
 }
 
-func (o *OAMblock) palette() bool {
-	return o.flags&0x10 != 0
+func (f *pixelFIFO) push(p fifoPixel) {
+	f.pix[(f.head+f.n)%pixelFIFOSize] = p
+	f.n++
 }
 
-func (v *Video) oamBlocks() [nOAMblocks]OAMblock {
-	i := uint(0)
-	out := [nOAMblocks]OAMblock{}
-	for n := uint(0); n < nOAMblocks; n++ {
-		out[n] = OAMblock{
-			v.oam.data[i],
-			v.oam.data[i+1],
-			v.oam.data[i+2],
-			v.oam.data[i+3],
-			n}
-		i += OAMblockSize
+// Popping an empty FIFO gives a transparent pixel.
+func (f *pixelFIFO) pop() fifoPixel {
+	if f.n == 0 {
+		return 0
 	}
+	p := f.pix[f.head]
+	f.head = (f.head + 1) % pixelFIFOSize
+	f.n--
+	return p
+}
 
-	return out
+// The i'th pixel from the front, which must already be there.
+func (f *pixelFIFO) at(i uint8) *fifoPixel {
+	return &f.pix[(f.head+i)%pixelFIFOSize]
 }
 
 const (
-	bgMapWidth          uint = 32
-	bgMapHeight         uint = 32
-	tileWidth           uint = 8
-	tileHeight          uint = 8
-	bgMapSize           uint = 0x400
-	bgMap1AddrInRAM     uint = 0x9800 - 0x8000
-	bgMap2AddrInRAM     uint = 0x9c00 - 0x8000
-	chrTilesBGMap1InRAM uint = 0x8000 - 0x8000
-	chrTilesBGMap2InRAM uint = 0x8800 - 0x8000
-	chrTilesSize        uint = 256 * 16
+	bgMapWidth      uint16 = 32
+	tileHeight      uint8  = 8
+	tileBytes       uint16 = 16
+	bgMap1AddrInRAM uint16 = 0x9800 - 0x8000
+	bgMap2AddrInRAM uint16 = 0x9c00 - 0x8000
+	// Where tile 0 is when tiles are numbered -128 to 127
+	signedTilesInRAM uint16 = 0x9000 - 0x8000
 )
 
-func (v *Video) bgMap(sys *Sys, dd2 bool) []byte {
-	if dd2 {
-		return v.videoRAM.data[bgMap2AddrInRAM : bgMap2AddrInRAM+bgMapSize]
-	}
-	return v.videoRAM.data[bgMap1AddrInRAM : bgMap1AddrInRAM+bgMapSize]
+// Palettes map colour numbers to shades, two bits each.
+func paletteShade(palette uint8, color Pixel) Pixel {
+	return Pixel(palette>>(2*color)) & 0x3
 }
 
-func (v *Video) chrTiles(sys *Sys, map2 bool) []byte {
-	if map2 {
-		return v.videoRAM.data[chrTilesBGMap2InRAM : chrTilesBGMap2InRAM+chrTilesSize]
-	}
-	return v.videoRAM.data[chrTilesBGMap1InRAM : chrTilesBGMap1InRAM+chrTilesSize]
+// The two bytes of a tile row, interleaved into colour numbers MSB first.
+func tileRowPixel(lo uint8, hi uint8, x uint8) Pixel {
+	return Pixel((lo>>(7-x))&1 | ((hi>>(7-x))&1)<<1)
 }
 
-func (v *Video) bgPalette() map[Pixel]Pixel {
-	val := v.bgp.val()
-	return map[Pixel]Pixel{
-		0: Pixel(val & 0x3),
-		1: Pixel((val >> 2) & 0x3),
-		2: Pixel((val >> 4) & 0x3),
-		3: Pixel((val >> 6) & 0x3),
+/*
+ * Find the first ten sprites (in OAM order) that are on this line. We do it
+ * all at once at the end of mode 2 rather than two cycles per sprite, since
+ * nothing can see the difference.
+ */
+func (v *Video) scanOAM() {
+	height := int(tileHeight)
+	if v.lcdc.val()&0x04 != 0 {
+		height *= 2
+	}
+	v.nLineSprites = 0
+	for i := uint8(0); i < 40 && v.nLineSprites < maxLineSprites; i++ {
+		y := int(v.oam.data[uint16(i)*4])
+		// Sprite Y is the line below its bottom when it's 8 tall
+		top := y - 16
+		if int(v.line) >= top && int(v.line) < top+height {
+			v.lineSprites[v.nLineSprites] = i
+			v.nLineSprites++
+		}
 	}
 }
 
-func (v *Video) obPalette0() map[Pixel]Pixel {
-	val := v.obp0.val()
-	return map[Pixel]Pixel{
-		0: Pixel(val & 0x3),
-		1: Pixel((val >> 2) & 0x3),
-		2: Pixel((val >> 4) & 0x3),
-		3: Pixel((val >> 6) & 0x3),
-	}
+func (v *Video) startDrawing() {
+	v.mode = modeDraw
+	v.lx = 0
+	v.discard = v.scx.val() & 0x07
+	v.windowActive = v.windowNextLine && v.lcdc.val()&0x20 != 0
+	v.windowNextLine = false
+	v.bgFIFO.clear()
+	v.objFIFO.clear()
+	v.fetchDot = 0
+	v.fetchX = 0
+	v.firstFetch = true
+	v.spritesFetched = 0
+	v.objFetching = false
 }
 
-func (v *Video) obPalette1() map[Pixel]Pixel {
-	val := v.obp1.val()
-	return map[Pixel]Pixel{
-		0: Pixel(val & 0x3),
-		1: Pixel((val >> 2) & 0x3),
-		2: Pixel((val >> 4) & 0x3),
-		3: Pixel((val >> 6) & 0x3),
+/*
+ * One cycle of mode 3. Every cycle we shift a pixel out of the FIFOs onto the
+ * screen, unless the background FIFO is empty or we're stalled fetching a
+ * sprite, and then clock the background fetcher. That makes mode 3 take 172
+ * cycles for a plain line: 6 for a fetch that gets thrown away, 6 for the
+ * first real one and 160 pixels. SCX%8 adds a cycle for every pixel thrown
+ * away for the fine scroll, starting the window adds another fetch and every
+ * sprite adds 6 to 11 cycles, depending on how long it has to wait for the
+ * background fetcher to finish what it's doing.
+ */
+func (v *Video) drawDot() {
+	lcdc := v.lcdc.val()
+	if v.objFetching {
+		v.stepSpriteFetch()
+		return
+	}
+	if v.bgFIFO.n > 0 && v.discard == 0 {
+		if !v.windowActive && v.windowStarts(lcdc) {
+			v.startWindow()
+			return
+		}
+		if lcdc&0x02 != 0 {
+			if slot, ok := v.nextSprite(); ok {
+				v.objFetching = true
+				v.objDot = 0
+				v.objSlot = slot
+				v.stepSpriteFetch()
+				return
+			}
+		}
+	}
+	if v.bgFIFO.n > 0 {
+		v.shiftPixel(lcdc)
+	}
+	v.stepFetcher()
+	if uint(v.lx) == LCDSizeX {
+		v.mode = modeHBlank
+		if v.windowActive {
+			v.windowLine++
+		}
 	}
 }
 
-func tilePix(chrTile []byte, x uint, y uint) Pixel {
-	//	b := chrTile[y*2+x/8]
-	// It's a doubletall sprite, so use the set of bytes
-	if y > 8 {
-		chrTile = chrTile[16:]
-		y -= 8
+/*
+ * The window starts once WX-7 reaches the pixel we're about to draw, as long
+ * as it's enabled and LY has matched WY at some point this frame. WX=166
+ * would only hit on the last pixel, and instead the hardware ends up drawing
+ * the window across the whole of the next line.
+ */
+func (v *Video) windowStarts(lcdc uint8) bool {
+	if lcdc&0x20 == 0 || !v.windowYHit {
+		return false
+	}
+	wx := v.wx.val()
+	if int(v.lx)+7 < int(wx) {
+		return false
 	}
-	lsbByte := chrTile[y*2]
-	msbByte := chrTile[y*2+1]
-	v := ((lsbByte >> (7 - x)) & 1) | (((msbByte >> (7 - x)) & 1) << 1)
-	//fmt.Printf("setting pixel value %v\n", v)
-	return Pixel(v)
+	if wx == 166 {
+		// Only once the fetcher's actually got there
+		v.windowNextLine = true
+		return false
+	}
+	return true
 }
 
-//func (v *Video) DumpTiles(sys *Sys) {
-//	fmt.Printf("tiles: %v\n", v.chrTiles(sys))
-//}
-
-// Draw the current line to the buffer. We do this at the beginning of mode 3
-// since that's when the gameboy no longer expects to be able to write to the
-// OAM or video RAM (although we let it do so anyway).
-
-func (v *Video) drawLine(sys *Sys) {
-	lcdc := v.lcdc.val()
-	bgMap := v.bgMap(sys, lcdc&0x08 != 0)
-	winMap := v.bgMap(sys, lcdc&0x40 != 0)
-	//fmt.Printf("bgMap: %v\n", bgMap)
-	//fmt.Printf("lcdc is %02Xh\n", lcdc)
-	startAt8800 := lcdc&0x10 == 0
-	chrTiles := v.chrTiles(sys, startAt8800)
-	spriteTiles := v.chrTiles(sys, false)
-
-	//v.DumpTiles(sys)
-	ly := uint(v.ly.val())
-	bgPalette := v.bgPalette()
-	// Oh god is this ugly...
-
-	// If the background is enabled then draw it first
-	if lcdc&0x01 != 0 {
-		y := uint(v.scy.val()) + ly
-		tileRow := (uint(y) / tileHeight) % bgMapHeight
-		tileY := uint(y) % tileHeight
-
-		scx := uint(v.scx.val())
-
-		for lcdX := uint(0); lcdX < LCDSizeX; lcdX++ {
-			//fmt.Printf("setting %v, %v\n", lcdX, ly)
-			x := scx + lcdX
-			//fmt.Printf("location in tilemap %v, %v\n", x, y)
-			tileColumn := (x / tileWidth) % bgMapWidth
-			//fmt.Printf("tile col/row %v, %v\n", tileColumn, tileRow)
-			tileX := (x) % tileWidth
-			//fmt.Printf("in-tile pix offset %v, %v\n", tileX, tileY)
-			//tileNum := bgMap[tileRow*bgMapWidth+tileColumn]
-			tileNum := bgMap[tileRow*bgMapWidth+tileColumn]
-			// These are signed, so remap them
-			//fmt.Printf("tile number %v\n", tileNum)
-			if startAt8800 {
-				//old := int(tileNum)
-				//if tileNum&0x80 != 0 {
-				//		old = -int(^uint(tileNum) + 1)
-				//	}
-				tileNum += 0x80
-				//fmt.Printf("converted from %v to %v\n", old, tileNum)
-			}
-
-			tileStart := uint(tileNum) * 16
-			//fmt.Printf("tile start idx %v\n", tileStart)
-			tile := chrTiles[tileStart : tileStart+16]
-			//fmt.Printf("Tile raw value %v+\n", tile)
+// Throw away the background and start fetching from the window instead.
+func (v *Video) startWindow() {
+	v.windowActive = true
+	v.bgFIFO.clear()
+	v.fetchDot = 0
+	v.fetchX = 0
+	// With WX<7 the window starts off the left of the screen
+	if wx := v.wx.val(); wx < 7 {
+		v.discard = 7 - wx
+	}
+	v.stepFetcher()
+}
 
-			v.buf[ly*LCDSizeX+lcdX] = bgPalette[tilePix(tile, tileX, tileY)]
+// Find the line sprite with the lowest X that's reached the current pixel
+// and hasn't been fetched yet. Ties go to the lowest OAM index.
+func (v *Video) nextSprite() (uint8, bool) {
+	found := false
+	best := uint8(0)
+	bestX := 0
+	for i := uint8(0); i < v.nLineSprites; i++ {
+		if v.spritesFetched&(1<<i) != 0 {
+			continue
 		}
-	}
-	// Now draw the window if it is enabled and we're within it.
-	wy := uint(v.wy.val())
-	wx := uint(v.wx.val())
-	if lcdc&0x10 != 0 && wy >= ly {
-		xStart := int(wx - 7)
-		if xStart < 0 {
-			xStart = 0
+		x := int(v.oam.data[uint16(v.lineSprites[i])*4+1])
+		if x > int(v.lx)+8 {
+			continue
 		}
-		y := ly - wy
-		tileRow := (uint(y) / tileHeight) % bgMapHeight
-		tileY := uint(y) % tileHeight
-		for lcdX := uint(xStart); lcdX < LCDSizeX; lcdX++ {
-			x := lcdX + 7 - wx
-			tileColumn := (x / tileWidth) % bgMapWidth
-			tileX := (x) % tileWidth
-			tileNum := winMap[tileRow*bgMapWidth+tileColumn]
-			if startAt8800 {
-				tileNum += 0x80
-			}
-			tileStart := uint(tileNum) * 16
-			tile := chrTiles[tileStart : tileStart+16]
-			v.buf[ly*LCDSizeX+lcdX] = bgPalette[tilePix(tile, tileX, tileY)]
+		if !found || x < bestX {
+			found = true
+			best = i
+			bestX = x
 		}
 	}
-	// Finally draw all the spirtes
-	if lcdc&0x02 != 0 {
-		v.drawSprites(sys, lcdc, ly, spriteTiles)
+	return best, found
+}
+
+// The background fetcher has to get to the end of the tile it's working on
+// before the sprite can be fetched, and then that takes another 6 cycles.
+func (v *Video) stepSpriteFetch() {
+	if v.fetchDot < fetcherLastFetchDot {
+		v.stepFetcher()
+		return
+	}
+	v.objDot++
+	if v.objDot < spriteFetchDots {
+		return
 	}
+	v.fetchSprite(v.lineSprites[v.objSlot])
+	v.spritesFetched |= 1 << v.objSlot
+	v.objFetching = false
 }
 
-func (v *Video) drawSprites(sys *Sys, lcdc uint8, ly uint, spriteTiles []byte) {
-	sprites := v.oamBlocks()
-	relevantSprites := []OAMblock{}
-	tallSprites := lcdc&0x04 != 0
-	obPalette0 := v.obPalette0()
-	obPalette1 := v.obPalette1()
-	for _, sprite := range sprites {
-		// We're above the sprite
-		if int(sprite.y)-16 <= int(ly) {
+func (v *Video) fetchSprite(index uint8) {
+	attrs := v.oam.data[uint16(index)*4 : uint16(index)*4+4]
+	y, x, tile, flags := attrs[0], attrs[1], attrs[2], attrs[3]
+	height := tileHeight
+	if v.lcdc.val()&0x04 != 0 {
+		// 8x16 sprites are an even tile with the odd one under it, no
+		// matter which of the two OAM says
+		height *= 2
+		tile &^= 0x01
+	}
+	row := v.line + 16 - y
+	if flags&0x40 != 0 {
+		row = height - 1 - row
+	}
+	addr := uint16(tile)*tileBytes + uint16(row)*2
+	lo := v.videoRAM.data[addr]
+	hi := v.videoRAM.data[addr+1]
+
+	attr := fifoPixel(0)
+	if flags&0x10 != 0 {
+		attr |= fifoPixelOBP1
+	}
+	if flags&0x80 != 0 {
+		attr |= fifoPixelBehindBG
+	}
+	for v.objFIFO.n < fifoPixelsPerFetch {
+		v.objFIFO.push(0)
+	}
+	for px := uint8(0); px < 8; px++ {
+		// Where this pixel is relative to the one about to be drawn,
+		// sprites that start off the left of the screen get clipped
+		slot := int(x) - 8 + int(px) - int(v.lx)
+		if slot < 0 {
 			continue
 		}
-		if tallSprites {
-			// We're below the sprite
-			if int(sprite.y)-16+16 > int(ly) {
-				continue
-			}
-		} else {
-			// We're below the sprite
-			if int(sprite.y)-16+8 > int(ly) {
-				continue
-			}
+		tx := px
+		if flags&0x20 != 0 {
+			tx = 7 - px
 		}
-		// If you made it this far then congratulations sprite, you're
-		// relevant!
-		relevantSprites = append(relevantSprites, sprite)
-	}
-	// Now sort the spirtes by x pos using idx as a tiebreaker; this places
-	// them in priority order.
-	sort.Sort(OAMblocksByReversePriority(relevantSprites))
-	if len(relevantSprites) > 10 {
-		fmt.Printf("!! More than 10 sprites on ly=%d", ly)
-		relevantSprites = relevantSprites[:10]
-	}
-
-	// Now just draw the sprites in reverse priority order. This will
-	// naturally cause higher priority sprites to be drawn over lower
-	// priority sprites.
-	for _, sprite := range relevantSprites {
-		xStart := int(sprite.x) - 8
-		if xStart < 0 {
-			xStart = 0
+		color := tileRowPixel(lo, hi, tx)
+		// Sprites fetched earlier win, so only fill in where they're
+		// transparent
+		if p := v.objFIFO.at(uint8(slot)); p.color() == 0 {
+			*p = attr | fifoPixel(color)
 		}
-		spriteY := (uint(sprite.y) + 16) - ly
-		if sprite.yFlip() {
-			if tallSprites {
-				spriteY = 16 - spriteY
-			} else {
-				spriteY = 8 - spriteY
-			}
-		}
-		tileNum := sprite.pattern
-		if tallSprites {
-			tileNum &^= 0x01
-		}
-		tileStart := uint(tileNum) * 16
-		var tile []byte
-		if tallSprites {
-			tile = spriteTiles[tileStart : tileStart+32]
-		} else {
-			tile = spriteTiles[tileStart : tileStart+16]
+	}
+}
+
+// Draw the pixel at the front of the FIFOs, or throw it away if it's
+// scrolled off.
+func (v *Video) shiftPixel(lcdc uint8) {
+	bg := v.bgFIFO.pop().color()
+	if v.discard > 0 {
+		v.discard--
+		return
+	}
+	obj := v.objFIFO.pop()
+	pix := paletteShade(v.bgp.val(), bg)
+	if lcdc&0x01 == 0 {
+		// The background and window go white, whatever BGP says
+		bg = 0
+		pix = 0
+	}
+	if obj.color() != 0 && lcdc&0x02 != 0 && (obj&fifoPixelBehindBG == 0 || bg == 0) {
+		palette := v.obp0.val()
+		if obj&fifoPixelOBP1 != 0 {
+			palette = v.obp1.val()
 		}
-		startX := int(sprite.x) - 8
-		if startX < 0 {
-			startX = 0
+		pix = paletteShade(palette, obj.color())
+	}
+	v.buf[uint(v.line)*LCDSizeX+uint(v.lx)] = pix
+	v.lx++
+}
+
+func (v *Video) stepFetcher() {
+	switch v.fetchDot {
+	case 1:
+		v.fetchTileNumber()
+	case 3:
+		v.tileLo = v.videoRAM.data[v.tileDataAddr()]
+	case fetcherLastFetchDot:
+		v.tileHi = v.videoRAM.data[v.tileDataAddr()+1]
+	}
+	if v.fetchDot < fetcherLastFetchDot {
+		v.fetchDot++
+		return
+	}
+	v.fetchDot = fetcherPushDot
+	if v.firstFetch {
+		v.firstFetch = false
+		v.fetchDot = 0
+		return
+	}
+	if v.bgFIFO.n > 0 {
+		return
+	}
+	for x := uint8(0); x < fifoPixelsPerFetch; x++ {
+		v.bgFIFO.push(fifoPixel(tileRowPixel(v.tileLo, v.tileHi, x)))
+	}
+	v.fetchX++
+	v.fetchDot = 0
+}
+
+// The row within the background or window map we're fetching from.
+func (v *Video) fetchY() uint8 {
+	if v.windowActive {
+		return v.windowLine
+	}
+	return v.line + v.scy.val()
+}
+
+func (v *Video) fetchTileNumber() {
+	lcdc := v.lcdc.val()
+	var mapAddr uint16
+	var column uint16
+	if v.windowActive {
+		mapAddr = bgMap1AddrInRAM
+		if lcdc&0x40 != 0 {
+			mapAddr = bgMap2AddrInRAM
 		}
-		for lcdX := uint(startX); lcdX < lcdX+8 && lcdX < LCDSizeX; lcdX++ {
-			// Sprite has lower priority than background and bg
-			// isn't 0, so skip this pixel.
-			// XXX(gerow): This doesn't take into account sprites
-			// of a lower priority getting drawn before.
-			if ((lcdc&0x80 != 0) || sprite.priority()) && v.buf[ly*LCDSizeX+lcdX] != 0 {
-				continue
-			}
-			spriteX := (uint(sprite.x) + 8) - lcdX
-			if sprite.xFlip() {
-				spriteX = 8 - spriteX
-			}
-			pix := tilePix(tile, spriteX, spriteY)
-			// We're a transparent pixel, so skip
-			if pix == 0 {
-				continue
-			}
-			if sprite.palette() {
-				pix = obPalette1[pix]
-			} else {
-				pix = obPalette0[pix]
-			}
-			v.buf[ly*LCDSizeX+lcdX] = pix
+		column = uint16(v.fetchX)
+	} else {
+		mapAddr = bgMap1AddrInRAM
+		if lcdc&0x08 != 0 {
+			mapAddr = bgMap2AddrInRAM
 		}
+		column = (uint16(v.scx.val()/8) + uint16(v.fetchX)) % bgMapWidth
+	}
+	row := uint16(v.fetchY()/tileHeight) % bgMapWidth
+	v.tileNum = v.videoRAM.data[mapAddr+row*bgMapWidth+column%bgMapWidth]
+}
+
+func (v *Video) tileDataAddr() uint16 {
+	row := uint16(v.fetchY()%tileHeight) * 2
+	if v.lcdc.val()&0x10 != 0 {
+		return uint16(v.tileNum)*tileBytes + row
 	}
+	// These are signed, so count from 9000h
+	return uint16(int(signedTilesInRAM)+int(int8(v.tileNum))*int(tileBytes)) + row
 }
@@ -61,3 +61,602 @@ func TestCorrectVideoThingAsserts(t *testing.T) {
 		t.Errorf("expected %04Xh to be handled by dma\n", 0xff46)
 	}
 }
+
+// A system with the PPU at the start of line 0 and the LCD on with just the
+// background enabled.
+func videoSys() *Sys {
+	s := S([]byte{})
+	s.video.lcdc.set(0x91)
+	s.video.bgp.set(0xe4)
+	s.video.obp0.set(0xe4)
+	s.video.obp1.set(0x1b)
+	return s
+}
+
+// Run the PPU through a whole line, returning how long mode 3 took.
+func runLine(s *Sys) int {
+	mode3 := 0
+	for i := 0; i < hCycles; i++ {
+		s.video.stepDot(s)
+		if s.video.mode == modeDraw {
+			mode3++
+		}
+	}
+	return mode3
+}
+
+// Fill a tile (in the 8000h tile data) with a single colour.
+func fillTile(s *Sys, tile uint8, color uint8) {
+	lo := uint8(0)
+	hi := uint8(0)
+	if color&1 != 0 {
+		lo = 0xff
+	}
+	if color&2 != 0 {
+		hi = 0xff
+	}
+	for row := uint16(0); row < 8; row++ {
+		s.Wb(0x8000+uint16(tile)*16+row*2, lo)
+		s.Wb(0x8000+uint16(tile)*16+row*2+1, hi)
+	}
+}
+
+func setSprite(s *Sys, index uint16, y uint8, x uint8, tile uint8, flags uint8) {
+	s.WriteBytes([]byte{y, x, tile, flags}, oamAddr+index*4)
+}
+
+func TestMode3Length(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		setup    func(s *Sys)
+		expected int
+	}{
+		{"plain", func(s *Sys) {}, 172},
+		{"SCX fine scroll", func(s *Sys) { s.Wb(scxRegAddr, 3) }, 175},
+		{"SCX coarse scroll", func(s *Sys) { s.Wb(scxRegAddr, 16) }, 172},
+		{"sprite on a tile boundary", func(s *Sys) {
+			s.video.lcdc.set(0x93)
+			setSprite(s, 0, 16, 8, 0, 0)
+		}, 183},
+		{"sprite late in a tile", func(s *Sys) {
+			s.video.lcdc.set(0x93)
+			setSprite(s, 0, 16, 13, 0, 0)
+		}, 178},
+		{"sprites disabled", func(s *Sys) { setSprite(s, 0, 16, 8, 0, 0) }, 172},
+		{"sprite off the right", func(s *Sys) {
+			s.video.lcdc.set(0x93)
+			setSprite(s, 0, 16, 168, 0, 0)
+		}, 172},
+		{"window", func(s *Sys) {
+			s.video.lcdc.set(0xb1)
+			s.Wb(0xff4b, 87)
+		}, 178},
+	} {
+		s := videoSys()
+		tc.setup(s)
+		if got := runLine(s); got != tc.expected {
+			t.Errorf("%s: expected mode 3 to take %d cycles, took %d\n", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestBackgroundScroll(t *testing.T) {
+	s := videoSys()
+	fillTile(s, 1, 3)
+	// Tile 1 in every other column of the first row
+	for col := uint16(0); col < 32; col += 2 {
+		s.Wb(0x9800+col, 1)
+	}
+	s.Wb(scxRegAddr, 3)
+	runLine(s)
+	for x := uint(0); x < LCDSizeX; x++ {
+		expected := Pixel(0)
+		if ((x+3)/8)%2 == 0 {
+			expected = 3
+		}
+		if got := s.video.buf[x]; got != expected {
+			t.Fatalf("expected pixel %d to be %d, got %d\n", x, expected, got)
+		}
+	}
+}
+
+func TestSignedTileData(t *testing.T) {
+	s := videoSys()
+	// Tile -1 is at 8FF0h with LCDC bit 4 clear
+	s.video.lcdc.set(0x81)
+	for row := uint16(0); row < 8; row++ {
+		s.Wb(0x8ff0+row*2, 0xff)
+	}
+	s.Wb(0x9800, 0xff)
+	runLine(s)
+	if got := s.video.buf[0]; got != 1 {
+		t.Errorf("expected tile -1 to be drawn, got %d\n", got)
+	}
+}
+
+func TestMidLinePaletteChange(t *testing.T) {
+	s := videoSys()
+	fillTile(s, 0, 1)
+	for s.video.mode != modeDraw || s.video.lx < 80 {
+		s.video.stepDot(s)
+	}
+	s.Wb(0xff47, 0xe4^0x0c)
+	runLine(s)
+	if got := s.video.buf[79]; got != 1 {
+		t.Errorf("expected pixel 79 to use the old palette, got %d\n", got)
+	}
+	if got := s.video.buf[80]; got != 2 {
+		t.Errorf("expected pixel 80 to use the new palette, got %d\n", got)
+	}
+}
+
+func TestBackgroundDisabled(t *testing.T) {
+	// With LCDC bit 0 clear the background and window are white, even
+	// with a palette that maps every colour to black
+	s := windowSys()
+	fillTile(s, 0, 3)
+	s.video.lcdc.set(0xf0)
+	s.video.bgp.set(0xff)
+	s.Wb(0xff4b, 87)
+	runLine(s)
+	for x := uint(0); x < LCDSizeX; x++ {
+		if got := s.video.buf[x]; got != 0 {
+			t.Fatalf("expected pixel %d to be white, got %d\n", x, got)
+		}
+	}
+}
+
+func setTileRow(s *Sys, tile uint16, row uint16, lo uint8, hi uint8) {
+	s.Wb(0x8000+tile*16+row*2, lo)
+	s.Wb(0x8000+tile*16+row*2+1, hi)
+}
+
+func runLines(s *Sys, n int) {
+	for i := 0; i < n; i++ {
+		runLine(s)
+	}
+}
+
+func checkPixel(t *testing.T, s *Sys, x uint, y uint, expected Pixel) {
+	if got := s.video.buf[y*LCDSizeX+x]; got != expected {
+		t.Errorf("expected pixel (%d, %d) to be %d, got %d\n", x, y, expected, got)
+	}
+}
+
+// A system with sprites on and a tile that's just a colour 3 dot in its top
+// left corner.
+func spriteSys() *Sys {
+	s := videoSys()
+	s.video.lcdc.set(0x93)
+	setTileRow(s, 1, 0, 0x80, 0x80)
+	return s
+}
+
+func TestSpriteFlip(t *testing.T) {
+	s := spriteSys()
+	setSprite(s, 0, 16, 8, 1, 0x00)
+	setSprite(s, 1, 16, 24, 1, 0x20)
+	setSprite(s, 2, 16, 40, 1, 0x40)
+	setSprite(s, 3, 16, 56, 1, 0x60)
+	runLines(s, 8)
+	checkPixel(t, s, 0, 0, 3)
+	checkPixel(t, s, 1, 0, 0)
+	checkPixel(t, s, 23, 0, 3)
+	checkPixel(t, s, 16, 0, 0)
+	checkPixel(t, s, 32, 7, 3)
+	checkPixel(t, s, 32, 0, 0)
+	checkPixel(t, s, 55, 7, 3)
+}
+
+func TestTallSprites(t *testing.T) {
+	s := spriteSys()
+	s.video.lcdc.set(0x97)
+	// The bottom half's dot, which is tile 3 no matter what OAM says
+	setTileRow(s, 3, 0, 0x80, 0x80)
+	setTileRow(s, 0, 0, 0x00, 0x00)
+	setSprite(s, 0, 16, 8, 3, 0x00)
+	setSprite(s, 1, 16, 24, 2, 0x40)
+	runLines(s, 16)
+	checkPixel(t, s, 0, 0, 0)
+	checkPixel(t, s, 0, 8, 3)
+	// Flipped, tile 3's top row ends up 7 lines from the top
+	checkPixel(t, s, 16, 7, 3)
+	checkPixel(t, s, 16, 15, 0)
+}
+
+func TestSpriteLineLimit(t *testing.T) {
+	s := spriteSys()
+	// Eleven sprites on the line, the last one in OAM furthest left
+	for i := uint16(0); i < 10; i++ {
+		setSprite(s, i, 16, uint8(16+i*8), 1, 0)
+	}
+	setSprite(s, 10, 16, 8, 1, 0)
+	runLine(s)
+	for i := uint(0); i < 10; i++ {
+		checkPixel(t, s, 8+i*8, 0, 3)
+	}
+	checkPixel(t, s, 0, 0, 0)
+}
+
+func TestSpritePriority(t *testing.T) {
+	s := spriteSys()
+	// A solid colour 1 tile, and one that's only solid on the left half
+	fillTile(s, 2, 1)
+	setTileRow(s, 3, 0, 0xf0, 0x00)
+	// The lower X wins, no matter the OAM order
+	setSprite(s, 0, 16, 12, 2, 0x00)
+	setSprite(s, 1, 16, 8, 2, 0x10)
+	// With the same X the lower index wins
+	setSprite(s, 2, 16, 32, 2, 0x00)
+	setSprite(s, 3, 16, 32, 2, 0x10)
+	// But the winner's transparent pixels show the other one
+	setSprite(s, 4, 16, 56, 3, 0x00)
+	setSprite(s, 5, 16, 56, 2, 0x10)
+	runLine(s)
+	checkPixel(t, s, 4, 0, 2)
+	checkPixel(t, s, 7, 0, 2)
+	checkPixel(t, s, 8, 0, 1)
+	checkPixel(t, s, 24, 0, 1)
+	checkPixel(t, s, 48, 0, 1)
+	checkPixel(t, s, 52, 0, 2)
+}
+
+func TestSpriteBehindBackground(t *testing.T) {
+	s := spriteSys()
+	// Background colour 1 in the left tile, colour 0 on the right
+	fillTile(s, 2, 1)
+	s.Wb(0x9800, 2)
+	fillTile(s, 3, 3)
+	setSprite(s, 0, 16, 12, 3, 0x80)
+	setSprite(s, 1, 16, 36, 3, 0x00)
+	s.Wb(0x9803, 2)
+	runLine(s)
+	// Behind colours 1-3, in front of 0
+	checkPixel(t, s, 4, 0, 1)
+	checkPixel(t, s, 8, 0, 3)
+	// Without the flag it's always in front
+	checkPixel(t, s, 28, 0, 3)
+	// Turning sprites off hides them
+	s = spriteSys()
+	s.video.lcdc.set(0x91)
+	setSprite(s, 0, 16, 8, 1, 0x00)
+	runLine(s)
+	checkPixel(t, s, 0, 0, 0)
+}
+
+// A system with the window map at 9C00h full of a tile with a colour 1 dot
+// in the column matching each row, so every window line shows which row of
+// the window it is. The background is blank.
+func windowSys() *Sys {
+	s := videoSys()
+	s.video.lcdc.set(0xf1)
+	for row := uint16(0); row < 8; row++ {
+		setTileRow(s, 1, row, 0x80>>row, 0)
+	}
+	for i := uint16(0); i < 0x400; i++ {
+		s.Wb(0x9c00+i, 1)
+	}
+	return s
+}
+
+// The window row drawn on a line, or -1 if there's no window there.
+func windowRow(s *Sys, line uint, windowX uint) int {
+	for x := windowX; x < windowX+8 && x < LCDSizeX; x++ {
+		if s.video.buf[line*LCDSizeX+x] != 0 {
+			return int(x - windowX)
+		}
+	}
+	return -1
+}
+
+func TestWindowEnableBit(t *testing.T) {
+	s := windowSys()
+	// Tile data select on, window off
+	s.video.lcdc.set(0xd1)
+	s.Wb(0xff4b, 7)
+	runLine(s)
+	if row := windowRow(s, 0, 0); row != -1 {
+		t.Errorf("expected no window with LCDC bit 5 clear, got row %d\n", row)
+	}
+	s.video.lcdc.set(0xf1)
+	runLine(s)
+	// It wasn't drawn on line 0, so it starts from its first row
+	if row := windowRow(s, 1, 0); row != 0 {
+		t.Errorf("expected window row 0, got %d\n", row)
+	}
+}
+
+func TestWindowLineCounter(t *testing.T) {
+	s := windowSys()
+	s.Wb(0xff4a, 2)
+	s.Wb(0xff4b, 87)
+	runLines(s, 4)
+	// Turning the window off for a couple of lines doesn't skip any rows
+	s.video.lcdc.set(0xd1)
+	runLines(s, 2)
+	s.video.lcdc.set(0xf1)
+	runLines(s, 2)
+	// Nor does pushing it off the right of the screen
+	s.Wb(0xff4b, 200)
+	runLine(s)
+	s.Wb(0xff4b, 87)
+	runLine(s)
+	for line, expected := range []int{-1, -1, 0, 1, -1, -1, 2, 3, -1, 4} {
+		if row := windowRow(s, uint(line), 80); row != expected {
+			t.Errorf("expected window row %d on line %d, got %d\n", expected, line, row)
+		}
+	}
+}
+
+func TestWindowWYLatch(t *testing.T) {
+	s := windowSys()
+	s.Wb(0xff4b, 7)
+	s.Wb(0xff4a, 1)
+	runLine(s)
+	// Moving WY above LY after it matched doesn't stop the window...
+	runLine(s)
+	s.Wb(0xff4a, 0)
+	runLine(s)
+	if row := windowRow(s, 2, 0); row != 1 {
+		t.Errorf("expected window row 1 on line 2, got %d\n", row)
+	}
+	// ...but moving it there without matching doesn't start it
+	s = windowSys()
+	s.Wb(0xff4b, 7)
+	s.Wb(0xff4a, 5)
+	runLines(s, 2)
+	s.Wb(0xff4a, 0)
+	runLine(s)
+	if row := windowRow(s, 2, 0); row != -1 {
+		t.Errorf("expected no window on line 2, got row %d\n", row)
+	}
+}
+
+func TestWindowWX(t *testing.T) {
+	// With WX<7 the left of the window is cut off
+	s := windowSys()
+	for row := uint16(0); row < 8; row++ {
+		setTileRow(s, 1, row, 0x08, 0)
+	}
+	s.Wb(0xff4b, 3)
+	runLine(s)
+	checkPixel(t, s, 0, 0, 1)
+	checkPixel(t, s, 4, 0, 0)
+	checkPixel(t, s, 8, 0, 1)
+
+	// WX=166 draws nothing on the line, then the whole of the next one
+	s = windowSys()
+	s.Wb(0xff4b, 166)
+	runLine(s)
+	if row := windowRow(s, 0, 152); row != -1 {
+		t.Errorf("expected no window on line 0, got row %d\n", row)
+	}
+	s.Wb(0xff4b, 200)
+	runLine(s)
+	if row := windowRow(s, 1, 0); row != 0 {
+		t.Errorf("expected window row 0 across line 1, got %d\n", row)
+	}
+	// That counts as a window line, so the next one carries on from it
+	s.Wb(0xff4b, 87)
+	runLine(s)
+	if row := windowRow(s, 2, 80); row != 1 {
+		t.Errorf("expected window row 1 on line 2, got %d\n", row)
+	}
+
+	// Moving WX away before the last pixel means it never happens, and
+	// the window line counter doesn't move
+	s = windowSys()
+	s.Wb(0xff4b, 166)
+	dots := 0
+	for s.video.mode != modeDraw || s.video.lx < 40 {
+		s.video.stepDot(s)
+		dots++
+	}
+	s.Wb(0xff4b, 200)
+	for ; dots < hCycles; dots++ {
+		s.video.stepDot(s)
+	}
+	runLine(s)
+	if row := windowRow(s, 1, 0); row != -1 {
+		t.Errorf("expected no window on line 1, got row %d\n", row)
+	}
+	s.Wb(0xff4b, 87)
+	runLine(s)
+	if row := windowRow(s, 2, 80); row != 0 {
+		t.Errorf("expected window row 0 on line 2, got %d\n", row)
+	}
+}
+
+// Step the PPU a cycle at a time, returning the dots (counting from the
+// start) that raised a STAT interrupt.
+func statInterrupts(s *Sys, dots int) []int {
+	var raised []int
+	for i := 0; i < dots; i++ {
+		s.ifReg.set(0)
+		s.video.stepDot(s)
+		if s.ifReg.val()&(1<<LCDStatInterrupt) != 0 {
+			raised = append(raised, i)
+		}
+	}
+	return raised
+}
+
+func TestSTATHBlankInterrupt(t *testing.T) {
+	s := videoSys()
+	s.Wb(statRegAddr, 1<<3)
+	raised := statInterrupts(s, hCycles)
+	// Mode 3 is 172 cycles on a plain line
+	if len(raised) != 1 || raised[0] != mode2Length+172-1 {
+		t.Errorf("expected one interrupt at the start of HBlank, got %v\n", raised)
+	}
+}
+
+func TestSTATBlocking(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stat     uint8
+		expected int
+	}{
+		{"mode 0", 1 << 3, 3},
+		{"mode 2", 1 << 5, 3},
+		// Mode 0 runs straight into mode 2, so the line never drops
+		// between them after the first
+		{"mode 0 and 2", 1<<3 | 1<<5, 4},
+		// LY=LYC on line 1 is surrounded by modes 2 and 0
+		{"mode 0 and LYC", 1<<3 | 1<<6, 3},
+	} {
+		s := videoSys()
+		s.Wb(0xff45, 1)
+		s.Wb(statRegAddr, tc.stat)
+		if raised := statInterrupts(s, 3*hCycles); len(raised) != tc.expected {
+			t.Errorf("%s: expected %d interrupts, got %d (%v)\n", tc.name, tc.expected, len(raised), raised)
+		}
+	}
+}
+
+func TestLYCTiming(t *testing.T) {
+	s := videoSys()
+	s.Wb(0xff45, 5)
+	runLines(s, 5)
+	// The comparison is false for the first cycle of a line
+	if s.Rb(statRegAddr)&0x04 != 0 {
+		t.Errorf("expected LY=LYC to be clear at the start of the line\n")
+	}
+	for i := 0; i < 4; i++ {
+		s.video.stepDot(s)
+	}
+	if s.Rb(statRegAddr)&0x04 == 0 {
+		t.Errorf("expected LY=LYC to be set\n")
+	}
+}
+
+func TestLine153(t *testing.T) {
+	s := videoSys()
+	runLines(s, totalLines-1)
+	if got := s.Rb(0xff44); got != 153 {
+		t.Errorf("expected LY=153, got %d\n", got)
+	}
+	for i := 0; i < 4; i++ {
+		s.video.stepDot(s)
+	}
+	if got := s.Rb(0xff44); got != 0 {
+		t.Errorf("expected LY to go to 0 early, got %d\n", got)
+	}
+
+	// So LYC=0 fires during line 153, and not again on line 0
+	s = videoSys()
+	runLines(s, totalLines-1)
+	s.Wb(0xff45, 0)
+	s.Wb(statRegAddr, 1<<6)
+	raised := statInterrupts(s, 2*hCycles)
+	if len(raised) != 1 || raised[0] >= hCycles {
+		t.Errorf("expected one LYC interrupt on line 153, got %v\n", raised)
+	}
+
+	// And LYC=153 only matches for a moment
+	s = videoSys()
+	runLines(s, totalLines-1)
+	s.Wb(0xff45, 153)
+	s.Wb(statRegAddr, 1<<6)
+	raised = statInterrupts(s, hCycles)
+	if len(raised) != 1 || raised[0] >= 8 {
+		t.Errorf("expected one LYC interrupt at the start of line 153, got %v\n", raised)
+	}
+}
+
+func TestOAMDMA(t *testing.T) {
+	s := videoSys()
+	for i := uint16(0); i < oamSize; i++ {
+		s.Wb(0xc000+i, uint8(i+1))
+	}
+	s.Wb(0xff46, 0xc0)
+	// A cycle to get going before the first byte
+	s.tick()
+	if s.video.oam.data[0] != 0 || s.video.dmaBlocks(0xc000) {
+		t.Errorf("expected DMA not to have started yet\n")
+	}
+	for i := uint16(0); i < oamSize; i++ {
+		s.tick()
+		if !s.video.dmaBlocks(0xc000) {
+			t.Fatalf("expected the bus to be blocked on cycle %d of the transfer\n", i)
+		}
+		if got := s.video.oam.data[i]; got != uint8(i+1) {
+			t.Fatalf("expected OAM byte %d to be %02Xh, got %02Xh\n", i, i+1, got)
+		}
+		if i+1 < oamSize && s.video.oam.data[i+1] != 0 {
+			t.Fatalf("expected OAM byte %d not to be copied yet\n", i+1)
+		}
+	}
+	s.tick()
+	if s.video.dmaBlocks(0xc000) {
+		t.Errorf("expected the bus to be free after 160 cycles\n")
+	}
+}
+
+func TestOAMDMARestart(t *testing.T) {
+	s := videoSys()
+	for i := uint16(0); i < oamSize; i++ {
+		s.Wb(0xc000+i, 0x11)
+		s.Wb(0xd000+i, 0x22)
+	}
+	s.Wb(0xff46, 0xc0)
+	for i := 0; i < 11; i++ {
+		s.tick()
+	}
+	s.Wb(0xff46, 0xd0)
+	// The old transfer carries on while the new one starts, so the bus
+	// stays blocked throughout
+	for i := uint16(0); i <= oamSize; i++ {
+		s.tick()
+		if !s.video.dmaBlocks(0xc000) {
+			t.Fatalf("expected the bus to be blocked on cycle %d after restarting\n", i)
+		}
+	}
+	for i := uint16(0); i < oamSize; i++ {
+		if got := s.video.oam.data[i]; got != 0x22 {
+			t.Fatalf("expected OAM byte %d to come from the second DMA, got %02Xh\n", i, got)
+		}
+	}
+}
+
+func TestOAMDMAEchoSource(t *testing.T) {
+	s := videoSys()
+	s.Wb(0xde00, 0x42)
+	s.Wb(0xff46, 0xfe)
+	s.tick()
+	s.tick()
+	if got := s.video.oam.data[0]; got != 0x42 {
+		t.Errorf("expected DMA from FE00h to read DE00h, got %02Xh\n", got)
+	}
+}
+
+func TestOAMDMABusConflict(t *testing.T) {
+	s := videoSys()
+	s.Wb(0xc000, 0x12)
+	s.WriteBytes([]byte{
+		0x3e, 0xc0, // LD A,C0h
+		0xe0, 0x46, // LDH (46h),A
+		0xfa, 0x00, 0xc0, // LD A,(C000h)
+		0x47,             // LD B,A
+		0xea, 0x01, 0xc0, // LD (C001h),A
+		0x3e, 0x28, // LD A,28h
+		0x3d,       // DEC A
+		0x20, 0xfd, // JR NZ,-3
+		0xfa, 0x00, 0xc0, // LD A,(C000h)
+		0x4f,       // LD C,A
+		0x18, 0xfe, // JR -2
+	}, 0xff80)
+	s.cpu.ip = 0xff80
+	for s.cpu.ip != 0xff80+20 {
+		s.Step()
+	}
+	if s.cpu.b != 0xff {
+		t.Errorf("expected a read from work RAM during DMA to see FFh, got %02Xh\n", s.cpu.b)
+	}
+	if got := s.Rb(0xc001); got != 0x00 {
+		t.Errorf("expected a write to work RAM during DMA to be dropped, got %02Xh\n", got)
+	}
+	if s.cpu.c != 0x12 {
+		t.Errorf("expected work RAM to be readable after DMA, got %02Xh\n", s.cpu.c)
+	}
+}
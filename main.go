@@ -6,14 +6,27 @@ import (
 	"github.com/gerow/blitzle/frontend"
 	"github.com/gerow/blitzle/gb"
 	"github.com/veandco/go-sdl2/sdl"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var debug = flag.Bool("debug", false, "enable debugging messages, very slow")
 var serial = flag.String("serial", "", "file to write serial output to")
+var save = flag.String("save", "", "battery save file, defaults to the ROM name with a .sav extension")
+var rewind = flag.Int("rewind", 32, "megabytes of rewind history to keep, 0 to disable")
+var headless = flag.Bool("headless", false, "run without a window for -frames frames, printing serial output")
+var frames = flag.Int("frames", 3600, "number of frames to run for in headless mode")
+var audio = flag.Bool("audio", true, "play sound, which also limits emulation to full speed")
+var wav = flag.String("wav", "", "file to record audio to as a WAV")
+var vgm = flag.String("vgm", "", "file to log sound register writes to as a VGM")
+var rtc = flag.String("rtc", "wall", "cartridge clock source, either wall or emulated")
 
 func main() {
 	// XXX(gerow): Hack for issues in go-sdl2
@@ -33,16 +46,107 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Print(r.Info())
-	sdl.Init(sdl.INIT_EVERYTHING)
-
+	if *headless {
+		fmt.Fprint(os.Stderr, r.Info())
+	} else {
+		fmt.Print(r.Info())
+	}
+	switch *rtc {
+	case "wall":
+		r.SetRTCSource(gb.RTCWallClock)
+	case "emulated":
+		r.SetRTCSource(gb.RTCEmulated)
+	default:
+		log.Fatalf("unknown clock source %q", *rtc)
+	}
+	savePath := *save
+	if savePath == "" {
+		savePath = strings.TrimSuffix(fn, filepath.Ext(fn)) + ".sav"
+	}
+	if err := r.OpenSave(savePath); err != nil {
+		log.Fatal(err)
+	}
 	sys := gb.NewSys(r)
 	sys.Debug = *debug
+	serialOut := []io.Writer{}
+	if *serial != "" {
+		f, err := os.Create(*serial)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		serialOut = append(serialOut, f)
+	}
+	if *headless {
+		serialOut = append(serialOut, os.Stdout)
+	}
+	if len(serialOut) != 0 {
+		sys.SetSerialSwapper(&frontend.WriterSerialSwapper{Writer: io.MultiWriter(serialOut...)})
+	}
+
+	recorders := []gb.AudioSink{}
+	if *wav != "" {
+		w, err := frontend.NewWAVSink(*wav, 44100)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeRecording(*wav, w)
+		recorders = append(recorders, w)
+	}
+	if *vgm != "" {
+		v, err := frontend.NewVGMSink(*vgm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeRecording(*vgm, v)
+		recorders = append(recorders, v)
+	}
+
+	if *headless {
+		runHeadless(sys, recorders)
+	} else {
+		runWindowed(sys, fn, recorders)
+	}
+	if err := r.WriteSave(); err != nil {
+		log.Printf("Failed to write save: %v\n", err)
+	}
+}
+
+func closeRecording(path string, c io.Closer) {
+	if err := c.Close(); err != nil {
+		log.Printf("Failed to write %s: %v\n", path, err)
+	}
+}
+
+// Run for a fixed number of frames without touching SDL at all.
+func runHeadless(sys *gb.Sys, recorders []gb.AudioSink) {
+	if len(recorders) != 0 {
+		sys.SetAudioSink(gb.MultiAudioSink(recorders...))
+	}
+	for i := 0; i < *frames; i++ {
+		sys.RunFrame()
+	}
+}
+
+func runWindowed(sys *gb.Sys, fn string, recorders []gb.AudioSink) {
+	sdl.Init(sdl.INIT_EVERYTHING)
 	fe, err := frontend.NewFrontend(sys)
 	if err != nil {
 		panic(err)
 	}
 	defer fe.Close()
+	fe.OnQuit = sys.Quit
+	fe.StatePrefix = strings.TrimSuffix(fn, filepath.Ext(fn))
+	if *rewind > 0 {
+		fe.EnableRewind(*rewind << 20)
+	}
+	// Make sure we still get to write out the save on ^C
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		sys.Quit()
+	}()
 	// Create a ticker to periodically pump SDL events.
 	ticker := time.NewTicker(time.Millisecond * 1)
 	go func() {
@@ -52,13 +156,19 @@ func main() {
 		}
 	}()
 	sys.SetVideoSwapper(fe)
-	if *serial != "" {
-		serialOut, err := os.Create(*serial)
+	sys.SetRumbler(fe)
+	sinks := recorders
+	if *audio {
+		sink, err := frontend.NewSDLAudioSink(44100)
 		if err != nil {
-			panic(err)
+			log.Printf("Failed to open audio device: %v\n", err)
+		} else {
+			defer sink.Close()
+			sinks = append([]gb.AudioSink{sink}, recorders...)
 		}
-		defer serialOut.Close()
-		sys.SetSerialSwapper(&frontend.WriterSerialSwapper{serialOut})
+	}
+	if len(sinks) != 0 {
+		sys.SetAudioSink(gb.MultiAudioSink(sinks...))
 	}
 
 	sys.Run()